@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"iter"
+)
+
+// Source is somewhere files are backed up from
+type Source interface {
+	// List returns everything below dir, folders included
+	List(dir string) ([]Item, error)
+	Stat(path string) (Item, error)
+	Open(path string) (io.ReadCloser, error)
+}
+
+// Walker is a Source that can hand its listing over as it goes, rather than all at once
+type Walker interface {
+	Walk(dir string) iter.Seq2[Item, error]
+}
+
+// Walk goes through dir in the source, as it is listed if the source can do that
+func Walk(src Source, dir string) iter.Seq2[Item, error] {
+	if walker, ok := src.(Walker); ok {
+		return walker.Walk(dir)
+	}
+	return func(yield func(Item, error) bool) {
+		items, err := src.List(dir)
+		if err != nil {
+			yield(Item{}, err)
+			return
+		}
+		for _, item := range items {
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Bounded is a Source or Destination that waits between retries, and can be told to stop waiting once
+// ctx is done so a retry doesn't carry on past the end of the run
+type Bounded interface {
+	Within(ctx context.Context)
+}
+
+// Destination is somewhere backups are kept. Items keep the path they had in the Source.
+type Destination interface {
+	List() ([]Item, error)
+	EnsureFolder(path string) error
+	// Put stores the file, replacing any copy already there
+	Put(item Item, reader io.Reader) error
+	Delete(item Item) error
+	Get(item Item) (io.ReadCloser, error)
+}
+
+// ChangeLister is a Destination that can say what has changed on its side since a token it gave out,
+// so it doesn't have to be listed in full every run
+type ChangeLister interface {
+	// StartToken is where changes start from, taken before a full listing so nothing is missed
+	StartToken() (string, error)
+	// Changes returns what was added or changed, the IDs of what was removed and the next token
+	Changes(token string) (changed []Item, removed []string, next string, err error)
+}
+
+// ErrFullListing means changes can't be applied and the destination needs listing in full
+var ErrFullListing = errors.New("changes can't be applied, a full listing is needed")
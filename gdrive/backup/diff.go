@@ -0,0 +1,178 @@
+package backup
+
+import (
+	"fmt"
+	"iter"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Action is one thing a Plan wants done, and why
+type Action struct {
+	Item   Item // the source item, or the backed up one for deletions
+	Reason string
+}
+
+// Plan is what Diff found. Unchanged files are only counted, they are the bulk of any big tree
+// and nothing needs doing with them.
+type Plan struct {
+	New         []Action
+	Modified    []Action
+	TypeChanged []Action // a file where a folder was backed up, or the other way round
+	Replaced    []Action // the backed up items in the way of a type change, and what is below them
+	Deleted     []Action
+	Unchanged   int
+}
+
+// Uploads is every file the plan wants uploaded
+func (p Plan) Uploads() []Item {
+	uploads := make([]Item, 0, len(p.New)+len(p.Modified)+len(p.TypeChanged))
+	for _, actions := range [][]Action{p.New, p.Modified, p.TypeChanged} {
+		for _, action := range actions {
+			if !action.Item.Dir {
+				uploads = append(uploads, action.Item)
+			}
+		}
+	}
+	return uploads
+}
+
+func (p Plan) Summary() string {
+	return fmt.Sprintf("%d new, %d modified, %d type changed, %d deleted, %d unchanged",
+		len(p.New), len(p.Modified), len(p.TypeChanged), len(p.Deleted), p.Unchanged)
+}
+
+// Deletions is every backed up file the plan wants removed
+func (p Plan) Deletions() []Item {
+	deletions := make([]Item, 0, len(p.Deleted))
+	for _, action := range p.Deleted {
+		deletions = append(deletions, action.Item)
+	}
+	return deletions
+}
+
+// Replacements is every backed up item that has to go before the type changes can be uploaded,
+// with what is in a folder before the folder
+func (p Plan) Replacements() []Item {
+	replaced := make([]Item, 0, len(p.Replaced))
+	for _, action := range p.Replaced {
+		replaced = append(replaced, action.Item)
+	}
+	sort.Slice(replaced, func(i, j int) bool { return replaced[i].Path > replaced[j].Path })
+	return replaced
+}
+
+// Files is how many files the source had
+func (p Plan) Files() int {
+	files := len(p.New) + len(p.Modified) + p.Unchanged
+	for _, action := range p.TypeChanged {
+		if !action.Item.Dir {
+			files++
+		}
+	}
+	return files
+}
+
+// Diff compares a source listing with what has been backed up, matching files by their normalised path.
+// Only backed up files below dir can be deleted, an empty dir means all of them.
+func Diff(sourceList, backedUp []Item, dir string) Plan {
+	plan, _ := DiffSeq(func(yield func(Item, error) bool) {
+		for _, item := range sourceList {
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}, backedUp, dir)
+	return plan
+}
+
+// DiffSeq is Diff for a source that is still being listed. Nothing is kept of the source beyond the changes,
+// backed up items are dropped from the lookup as they are matched so what is left over is what was deleted.
+func DiffSeq(source iter.Seq2[Item, error], backedUp []Item, dir string) (Plan, error) {
+	remote := make(map[string]int, len(backedUp))
+	for i, item := range backedUp {
+		remote[NormalizePath(item.Path)] = i
+	}
+
+	var plan Plan
+	replacedDirs := make(map[string]bool) // backed up folders a file is taking the place of
+	for item, err := range source {
+		if err != nil {
+			return Plan{}, err
+		}
+		key := NormalizePath(item.Path)
+		i, ok := remote[key]
+		if !ok {
+			if !item.Dir {
+				plan.New = append(plan.New, Action{Item: item, Reason: "not backed up"})
+			}
+			continue
+		}
+		delete(remote, key)
+		existing := backedUp[i]
+		switch {
+		case item.Dir && existing.Dir:
+		case item.Dir:
+			plan.TypeChanged = append(plan.TypeChanged, Action{Item: item, Reason: "is a folder, a file was backed up"})
+			plan.Replaced = append(plan.Replaced, Action{Item: existing, Reason: "a folder is there now"})
+		case existing.Dir:
+			plan.TypeChanged = append(plan.TypeChanged, Action{Item: item, Reason: "is a file, a folder was backed up"})
+			plan.Replaced = append(plan.Replaced, Action{Item: existing, Reason: "a file is there now"})
+			replacedDirs[key] = true
+		case !item.ModificationTime.Equal(existing.ModificationTime):
+			plan.Modified = append(plan.Modified, Action{Item: item,
+				Reason: fmt.Sprintf("modified %s, backup is from %s", item.ModificationTime, existing.ModificationTime)})
+		default:
+			plan.Unchanged++
+		}
+	}
+
+	prefix := ""
+	if dir != "" {
+		prefix = NormalizePath(dir) + "/"
+	}
+	for _, item := range backedUp {
+		key := NormalizePath(item.Path)
+		if _, left := remote[key]; !left {
+			continue
+		}
+		if below(key, replacedDirs) {
+			plan.Replaced = append(plan.Replaced, Action{Item: item, Reason: "in a folder a file is there now"})
+			continue
+		}
+		if item.Dir || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		plan.Deleted = append(plan.Deleted, Action{Item: item, Reason: "gone from the source"})
+	}
+	return plan, nil
+}
+
+// below says if key is inside any of dirs
+func below(key string, dirs map[string]bool) bool {
+	if len(dirs) == 0 {
+		return false
+	}
+	for parent := path.Dir(key); len(parent) > 1; parent = path.Dir(parent) {
+		if dirs[parent] {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizePath puts a path in the form used to match files up, so trailing slashes, doubled
+// slashes and the different ways of writing accented characters (macOS decomposes them) all match
+func NormalizePath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	p = path.Clean(p) // already clean paths, nearly all of them, come back without a copy
+	if p == "/" {
+		return ""
+	}
+	return norm.NFC.String(p)
+}
@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	modTime := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	source := []Item{
+		{Path: "/docs", Dir: true},
+		{Path: "/docs/same.txt", ModificationTime: modTime},
+		{Path: "/docs/edited.txt", ModificationTime: modTime.Add(time.Hour)},
+		{Path: "/docs/new.txt", ModificationTime: modTime},
+		{Path: "/docs/café.txt", ModificationTime: modTime}, // decomposed, like macOS writes it
+		{Path: "/docs/was-a-folder", ModificationTime: modTime},
+		{Path: "/docs/now-a-folder", Dir: true},
+		{Path: "/docs/new-folder", Dir: true},
+	}
+	backedUp := []Item{
+		{Path: "/docs/", Dir: true},
+		{Path: "/docs/same.txt", ModificationTime: modTime},
+		{Path: "/docs//edited.txt", ModificationTime: modTime},
+		{Path: "/docs/café.txt", ModificationTime: modTime},
+		{Path: "/docs/was-a-folder", Dir: true},
+		{Path: "/docs/now-a-folder", ModificationTime: modTime},
+		{Path: "/docs/removed.txt", ModificationTime: modTime},
+		{Path: "/photos/other-dir.jpg", ModificationTime: modTime},
+	}
+
+	plan := Diff(source, backedUp, "/docs")
+	require.Equal(t, []string{"/docs/new.txt"}, actionPaths(plan.New))
+	require.Equal(t, []string{"/docs/edited.txt"}, actionPaths(plan.Modified))
+	require.Equal(t, []string{"/docs/was-a-folder", "/docs/now-a-folder"}, actionPaths(plan.TypeChanged))
+	require.Equal(t, []string{"/docs/was-a-folder", "/docs/now-a-folder"}, actionPaths(plan.Replaced))
+	require.Equal(t, []string{"/docs/removed.txt"}, actionPaths(plan.Deleted))
+	require.Equal(t, 2, plan.Unchanged)
+	require.Equal(t, []string{"/docs/new.txt", "/docs/edited.txt", "/docs/was-a-folder"}, paths(plan.Uploads()))
+	require.Equal(t, 5, plan.Files(), "the folder that was a file isn't one")
+	require.Equal(t, "1 new, 1 modified, 2 type changed, 1 deleted, 2 unchanged", plan.Summary())
+
+	require.Len(t, Diff(source, backedUp, "").Deleted, 2)
+}
+
+func actionPaths(actions []Action) []string {
+	var p []string
+	for _, action := range actions {
+		p = append(p, action.Item.Path)
+	}
+	return p
+}
+
+func BenchmarkDiff(b *testing.B) {
+	modTime := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	const files = 1_000_000
+	source := make([]Item, files)
+	backedUp := make([]Item, files)
+	for i := range source {
+		filePath := fmt.Sprintf("/docs/%d/%d.txt", i/1000, i)
+		source[i] = Item{Path: filePath, ModificationTime: modTime}
+		backedUp[i] = Item{Path: filePath, ModificationTime: modTime}
+		if i%100 == 0 {
+			source[i].ModificationTime = modTime.Add(time.Hour)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		plan := Diff(source, backedUp, "/docs")
+		if len(plan.Modified) != files/100 {
+			b.Fatalf("expected %d modified, got %d", files/100, len(plan.Modified))
+		}
+	}
+}
@@ -1,88 +1,339 @@
 package backup
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// Encrypted files are written as
+//
+//	magic | version | kdf [| argon2 settings | salt] | key ID | chunk size | nonce prefix | chunk... | final chunk
+//
+// Each chunk is sealed with AES-GCM. The nonce is the prefix, the chunk counter
+// and a flag marking the last chunk, and the header is the additional data, so
+// a file that has been cut short, reordered or changed will not open.
+// Files without the magic are from before this format and use AES-CFB.
+const (
+	magic            = "GDBK"
+	formatVersion    = 1
+	kdfRaw           = 0
+	keyIDSize        = 8
+	noncePrefixSize  = 7
+	defaultChunkSize = 64 * 1024
+	maxChunkSize     = 16 * 1024 * 1024
+)
+
+var (
+	ErrWrongKey = errors.New("file was encrypted with a different key")
+	ErrCorrupt  = errors.New("encrypted file is damaged, truncated or has been tampered with")
+)
+
 func Encrypt(key []byte, file io.ReadCloser) (io.ReadCloser, error) {
-	block, err := aes.NewCipher(key)
+	k, err := RawKey(key)
 	if err != nil {
 		return nil, err
 	}
+	return k.Encrypt(file)
+}
 
-	// Generate a unique IV
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+func newEncryptReader(k *Key, file io.ReadCloser, chunkSize int) (*encryptReader, error) {
+	header, err := newHeader(k, chunkSize)
+	if err != nil {
 		return nil, err
 	}
+	return encryptFrom(k, header, file, 0)
+}
 
-	// Create a new reader for the encrypted data
-	encryptedReader := &cipher.StreamReader{
-		S: cipher.NewCFBEncrypter(block, iv),
-		R: file,
+// newHeader makes the header for a new file, with a fresh nonce prefix
+func newHeader(k *Key, chunkSize int) ([]byte, error) {
+	kdfHeader, key := k.header()
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
 	}
 
-	// Create a new reader that includes the IV at the beginning
-	return &ivReader{
-		iv:        iv,
-		encrypted: encryptedReader,
-	}, nil
+	header := bytes.NewBufferString(magic)
+	header.WriteByte(formatVersion)
+	header.Write(kdfHeader)
+	header.Write(keyID(key))
+	binary.Write(header, binary.BigEndian, uint32(chunkSize))
+	header.Write(prefix)
+	return header.Bytes(), nil
+}
+
+// encryptFrom encrypts file, which starts at chunk, under a header that has already been made.
+// The same header and plaintext always give the same output, which is what lets uploads resume.
+// Only chunk 0 comes out with the header in front.
+func encryptFrom(k *Key, header []byte, file io.ReadCloser, chunk uint32) (*encryptReader, error) {
+	header, key, chunkSize, prefix, err := readHeader(k, bytes.NewReader(header))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &encryptReader{
+		chunker: chunker{aead: aead, header: header, prefix: prefix, counter: chunk},
+		source:  file,
+		plain:   make([]byte, chunkSize+1),
+		buf:     make([]byte, 0, chunkSize+aead.Overhead()),
+	}
+	if chunk == 0 {
+		r.out = header
+	}
+	return r, nil
 }
 
 func Decrypt(key []byte, file io.ReadCloser) (io.ReadCloser, error) {
-	block, err := aes.NewCipher(key)
+	k, err := RawKey(key)
 	if err != nil {
 		return nil, err
 	}
+	return k.Decrypt(file)
+}
 
-	// Read the first block of the file
-	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(file, iv); err != nil {
+func decrypt(k *Key, file io.ReadCloser) (io.ReadCloser, error) {
+	reader := bufio.NewReader(file)
+	start, err := reader.Peek(len(magic))
+	if err != nil && err != io.EOF {
 		return nil, err
 	}
+	if string(start) != magic {
+		if k.raw == nil {
+			return nil, errors.New("file is in the old format, which needs a raw key")
+		}
+		return decryptLegacy(k.raw, reader, file)
+	}
 
-	// Create a new reader for the encrypted data
-	encryptedReader := &cipher.StreamReader{
-		S: cipher.NewCFBDecrypter(block, iv),
-		R: file,
+	header, key, chunkSize, prefix, err := readHeader(k, reader)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create a new reader that includes the IV at the beginning
-	return &ivReader{
-		iv:            iv,
-		encrypted:     encryptedReader,
-		EncryptedFile: true,
+	return &decryptReader{
+		chunker: chunker{aead: aead, header: header, prefix: prefix},
+		source:  reader,
+		closer:  file,
+		sealed:  make([]byte, chunkSize+aead.Overhead()+1),
+		buf:     make([]byte, 0, chunkSize),
 	}, nil
 }
 
-// ivReader is a reader that prepends the IV to the encrypted data
-type ivReader struct {
-	iv            []byte
-	encrypted     io.Reader
-	EncryptedFile bool
+// readHeader reads and checks the header, returning the raw bytes so they can be
+// authenticated along with the AES key, chunk size and nonce prefix
+func readHeader(k *Key, reader io.Reader) ([]byte, []byte, int, []byte, error) {
+	start := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(reader, start); err != nil {
+		return nil, nil, 0, nil, ErrCorrupt
+	}
+	if start[len(magic)] != formatVersion {
+		return nil, nil, 0, nil, fmt.Errorf("unsupported encryption format version %d", start[len(magic)])
+	}
+	kdfHeader, key, err := k.readHeader(reader)
+	if err != nil {
+		return nil, nil, 0, nil, err
+	}
+	rest := make([]byte, keyIDSize+4+noncePrefixSize)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return nil, nil, 0, nil, ErrCorrupt
+	}
+	if !bytes.Equal(rest[:keyIDSize], keyID(key)) {
+		return nil, nil, 0, nil, ErrWrongKey
+	}
+	chunkSize := binary.BigEndian.Uint32(rest[keyIDSize:])
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return nil, nil, 0, nil, ErrCorrupt
+	}
+
+	header := append(append(start, kdfHeader...), rest...)
+	return header, key, int(chunkSize), rest[keyIDSize+4:], nil
 }
 
-func (r *ivReader) Read(p []byte) (n int, err error) {
-	// If we haven't written the IV yet, do it now
-	if len(r.iv) > 0 {
-		if r.EncryptedFile { // Just skip over this block
-			r.iv = nil
-			return 0, nil
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyID lets us tell a wrong key apart from a damaged file without giving the key away
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(append([]byte("gdrive-backup key id:"), key...))
+	return sum[:keyIDSize]
+}
+
+// chunker holds what is shared between sealing and opening chunks
+type chunker struct {
+	aead    cipher.AEAD
+	header  []byte
+	prefix  []byte
+	counter uint32
+}
+
+func (c *chunker) nonce(final bool) []byte {
+	nonce := make([]byte, 0, c.aead.NonceSize())
+	nonce = append(nonce, c.prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, c.counter)
+	if final {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptReader seals the source a chunk at a time as it is read
+type encryptReader struct {
+	chunker
+	source io.ReadCloser
+	plain  []byte // one chunk plus a byte, to tell if there is more to come
+	held   int    // bytes already in plain from the last read
+	buf    []byte
+	out    []byte
+	done   bool
+	err    error // once a read fails every read after it does too
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
 		}
+		r.err = r.sealNext()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
 
-		n = copy(p, r.iv)
-		r.iv = nil
-		return n, nil
+func (r *encryptReader) sealNext() error {
+	n, err := io.ReadFull(r.source, r.plain[r.held:])
+	n += r.held
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	chunkSize := len(r.plain) - 1
+	final := n <= chunkSize
+	if final {
+		r.out = r.aead.Seal(r.buf, r.nonce(true), r.plain[:n], r.header)
+		r.done = true
+		return nil
 	}
 
-	// Read the encrypted data
-	return r.encrypted.Read(p)
+	r.out = r.aead.Seal(r.buf, r.nonce(false), r.plain[:chunkSize], r.header)
+	r.plain[0] = r.plain[chunkSize]
+	r.held = 1
+	r.counter++
+	if r.counter == 0 {
+		return errors.New("file is too large to encrypt")
+	}
+	return nil
+}
+
+func (r *encryptReader) Close() error {
+	return r.source.Close()
+}
+
+// decryptReader opens the chunks written by encryptReader
+type decryptReader struct {
+	chunker
+	source io.Reader
+	closer io.Closer
+	sealed []byte // one sealed chunk plus a byte, to tell if it is the last
+	held   int
+	buf    []byte
+	out    []byte
+	done   bool
+	err    error // once a read fails every read after it does too
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.openNext()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
 }
 
-func (r *ivReader) Close() error {
+func (r *decryptReader) openNext() error {
+	n, err := io.ReadFull(r.source, r.sealed[r.held:])
+	n += r.held
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	sealedSize := len(r.sealed) - 1
+	final := n <= sealedSize
+
+	var plain []byte
+	if final {
+		plain, err = r.aead.Open(r.buf, r.nonce(true), r.sealed[:n], r.header)
+		r.done = true
+	} else {
+		plain, err = r.aead.Open(r.buf, r.nonce(false), r.sealed[:sealedSize], r.header)
+		r.sealed[0] = r.sealed[sealedSize]
+		r.held = 1
+		r.counter++
+	}
+	if err != nil {
+		return ErrCorrupt
+	}
+	r.out = plain
 	return nil
-	// return r.encrypted.Close()
+}
+
+func (r *decryptReader) Close() error {
+	return r.closer.Close()
+}
+
+// decryptLegacy reads files written before the chunked format, which are the IV followed by AES-CFB
+func decryptLegacy(key []byte, reader io.Reader, file io.Closer) (io.ReadCloser, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(reader, iv); err != nil {
+		return nil, err
+	}
+
+	return &legacyReader{
+		Reader: &cipher.StreamReader{
+			S: cipher.NewCFBDecrypter(block, iv),
+			R: reader,
+		},
+		closer: file,
+	}, nil
+}
+
+type legacyReader struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (r *legacyReader) Close() error {
+	return r.closer.Close()
 }
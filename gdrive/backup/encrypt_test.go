@@ -1,6 +1,7 @@
 package backup
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"testing"
@@ -44,3 +45,86 @@ func TestDecrypt(t *testing.T) {
 	err = os.WriteFile("test/test.dec", result, 0644)
 	require.NoError(t, err)
 }
+
+func encryptBytes(t *testing.T, key, plain []byte, chunkSize int) []byte {
+	k, err := RawKey(key)
+	require.NoError(t, err)
+	enc, err := newEncryptReader(k, io.NopCloser(bytes.NewReader(plain)), chunkSize)
+	require.NoError(t, err)
+	sealed, err := io.ReadAll(enc)
+	require.NoError(t, err)
+	return sealed
+}
+
+func decryptBytes(key, sealed []byte) ([]byte, error) {
+	dec, err := Decrypt(key, io.NopCloser(bytes.NewReader(sealed)))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(dec)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := []byte("PPKpKqSMGfX43h2qJbP9cpkn886u9Y2D")
+	for _, size := range []int{0, 1, 15, 16, 17, 32, 100} {
+		plain := bytes.Repeat([]byte{'a'}, size)
+		sealed := encryptBytes(t, key, plain, 16)
+		result, err := decryptBytes(key, sealed)
+		require.NoError(t, err, "size %d", size)
+		require.Equal(t, plain, result, "size %d", size)
+	}
+}
+
+func TestDecryptFailsOnDamage(t *testing.T) {
+	key := []byte("PPKpKqSMGfX43h2qJbP9cpkn886u9Y2D")
+	plain := []byte("0123456789abcdef0123456789abcdef0123")
+	sealed := encryptBytes(t, key, plain, 16)
+	headerSize := len(magic) + 2 + keyIDSize + 4 + noncePrefixSize
+	chunk := 16 + 16 // chunk plus the GCM tag
+
+	truncatedAtChunk := sealed[:headerSize+2*chunk]
+	_, err := decryptBytes(key, truncatedAtChunk)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	truncated := sealed[:len(sealed)-3]
+	_, err = decryptBytes(key, truncated)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	headerOnly := sealed[:headerSize]
+	_, err = decryptBytes(key, headerOnly)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	tampered := bytes.Clone(sealed)
+	tampered[headerSize+chunk+3] ^= 1
+	_, err = decryptBytes(key, tampered)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	reordered := bytes.Clone(sealed)
+	copy(reordered[headerSize:], sealed[headerSize+chunk:headerSize+2*chunk])
+	copy(reordered[headerSize+chunk:], sealed[headerSize:headerSize+chunk])
+	_, err = decryptBytes(key, reordered)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	extended := append(bytes.Clone(sealed), 0)
+	_, err = decryptBytes(key, extended)
+	require.ErrorIs(t, err, ErrCorrupt)
+
+	_, err = decryptBytes([]byte("0000000000000000000000000000000X"), sealed)
+	require.ErrorIs(t, err, ErrWrongKey)
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	file, err := os.Open("test/legacy.enc")
+	require.NoError(t, err)
+	defer file.Close()
+
+	key := []byte("PPKpKqSMGfX43h2qJbP9cpkn886u9Y2D")
+	decFile, err := Decrypt(key, file)
+	require.NoError(t, err)
+	result, err := io.ReadAll(decFile)
+	require.NoError(t, err)
+
+	expected, err := os.ReadFile("test/test.base")
+	require.NoError(t, err)
+	require.Equal(t, expected, result)
+}
@@ -0,0 +1,123 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+)
+
+// Hasher is a Source that can give the SHA-256 of a file without it being downloaded.
+// An empty hash means it doesn't know this one.
+type Hasher interface {
+	Hash(path string) (string, error)
+}
+
+// HashFile returns the SHA-256 of the file's contents as hex, asking the source first if it can say
+func HashFile(src Source, filePath string) (string, error) {
+	if hasher, ok := src.(Hasher); ok {
+		hash, err := hasher.Hash(filePath)
+		if err != nil {
+			log.Printf("Could not get the checksum of %s from the source, reading it instead, %s", filePath, err)
+		} else if hash != "" {
+			return hash, nil
+		}
+	}
+
+	f, err := src.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("could not open %s to hash it, %s", filePath, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("could not read %s to hash it, %s", filePath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Retagger is a Destination that can bring the hash, source ETag and modification time kept with a
+// backup up to date, without the file going up again
+type Retagger interface {
+	Retag(item Item) error
+}
+
+// FindChangesByHash works out what needs uploading by comparing contents instead of modification times.
+// Files whose source ETag matches the one stored with the backup are taken as unchanged without reading them.
+// Backups with no hash stored, from before hash mode or on destinations that can't keep one, are compared by
+// modification time. Changed files come back with Hash set when it was worked out, the rest are hashed as
+// they upload. Touched files, that were read and turned out the same, come back separately with the backup's
+// ID and hash so their new ETag and modification time can be kept and they aren't read again next time.
+func FindChangesByHash(sourceList, backedUp []Item, src Source) (changes, touched []Item) {
+	remote := make(map[string]Item, len(backedUp))
+	for _, item := range backedUp {
+		remote[NormalizePath(item.Path)] = item
+	}
+
+	for _, item := range sourceList {
+		if item.Dir {
+			continue
+		}
+		existing, ok := remote[NormalizePath(item.Path)]
+		if !ok || existing.Dir {
+			changes = append(changes, item)
+			continue
+		}
+		if existing.Hash == "" {
+			if !item.ModificationTime.Equal(existing.ModificationTime) {
+				changes = append(changes, item)
+			}
+			continue
+		}
+		if item.ETag != "" && item.ETag == existing.ETag {
+			continue
+		}
+
+		hash, err := HashFile(src, item.Path)
+		if err != nil {
+			log.Printf("%s, uploading it to be safe", err)
+			changes = append(changes, item)
+			continue
+		}
+		item.Hash = hash
+		if hash != existing.Hash {
+			changes = append(changes, item)
+			continue
+		}
+		if item.ETag != existing.ETag || !item.ModificationTime.Equal(existing.ModificationTime) {
+			item.ID = existing.ID
+			touched = append(touched, item)
+		}
+	}
+	return changes, touched
+}
+
+// hashingReader works out the hash of everything read through it
+type hashingReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	done bool // read to the end, so the hash is of the whole file
+}
+
+func newHashingReader(r io.ReadCloser) *hashingReader {
+	return &hashingReader{ReadCloser: r, hash: sha256.New()}
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		r.done = true
+	}
+	return n, err
+}
+
+// Sum is the hash as hex, or empty if the file wasn't read to the end
+func (r *hashingReader) Sum() string {
+	if r == nil || !r.done {
+		return ""
+	}
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
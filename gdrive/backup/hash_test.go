@@ -0,0 +1,39 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFindChangesByHash(t *testing.T) {
+	modTime := time.Date(2024, 7, 14, 10, 30, 0, 0, time.UTC)
+	src := newMemBackend()
+	src.add("/docs/touched.txt", "same", modTime.Add(time.Hour))
+	src.add("/docs/edited.txt", "new contents", modTime)
+	src.add("/docs/etag.txt", "not read", modTime.Add(time.Hour))
+	src.add("/docs/new.txt", "new", modTime)
+	src.add("/docs/old.txt", "old backup", modTime.Add(time.Hour))
+	etag := src.items["/docs/etag.txt"]
+	etag.ETag = `"abc"`
+	src.items["/docs/etag.txt"] = etag
+
+	same, err := HashFile(memSource{src}, "/docs/touched.txt")
+	require.NoError(t, err)
+	require.Equal(t, "0967115f2813a3541eaef77de9d9d5773f1c0c04314b0bbfe4ff3b3b1c55b5d5", same)
+	backedUp := []Item{
+		{Path: "/docs/touched.txt", ModificationTime: modTime, Hash: same},
+		{Path: "/docs/edited.txt", ModificationTime: modTime, Hash: same},
+		{Path: "/docs/etag.txt", ModificationTime: modTime, Hash: "something else", ETag: `"abc"`},
+		{Path: "/docs/old.txt", ModificationTime: modTime},
+	}
+
+	sourceList, err := src.list("/docs")
+	require.NoError(t, err)
+	changes, touched := FindChangesByHash(sourceList, backedUp, memSource{src})
+	require.ElementsMatch(t, []string{"/docs/edited.txt", "/docs/new.txt", "/docs/old.txt"}, paths(changes))
+	require.Equal(t, []string{"/docs/touched.txt"}, paths(touched))
+	require.Equal(t, same, touched[0].Hash)
+	require.Equal(t, modTime.Add(time.Hour), touched[0].ModificationTime, "the new time is kept so it isn't read again")
+}
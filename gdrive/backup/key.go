@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+const (
+	kdfArgon2id = 1
+	saltSize    = 16
+	// argon2 settings for new files, the ones a file was written with are kept in its header
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+	// limits on what we will accept from a header, so a bad file can't eat all the memory. Every read of
+	// a different salt can take this much, so it is kept to a few times what new files use.
+	maxArgonTime   = 64
+	maxArgonMemory = 256 * 1024 // KiB
+)
+
+// Key is what a directory is encrypted with, either a raw AES key or a passphrase
+// that AES keys are derived from with argon2id.
+type Key struct {
+	raw        []byte
+	passphrase []byte
+	params     kdfParams // used for the files we write
+
+	lock    sync.Mutex
+	derived map[kdfParams][]byte // argon2 is slow on purpose, so only derive each salt once
+}
+
+type kdfParams struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    [saltSize]byte
+}
+
+// RawKey uses key as the AES key directly
+func RawKey(key []byte) (*Key, error) {
+	switch len(key) {
+	case 16, 24, 32:
+		return &Key{raw: key}, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes long, not %d", len(key))
+}
+
+// PassphraseKey derives AES keys from the passphrase. Every file written with this
+// Key shares one random salt, which is stored in the file header along with the
+// argon2 settings so the passphrase alone is enough to decrypt.
+func PassphraseKey(passphrase []byte) (*Key, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("passphrase is empty")
+	}
+	params := kdfParams{time: argonTime, memory: argonMemory, threads: argonThreads}
+	if _, err := io.ReadFull(rand.Reader, params.salt[:]); err != nil {
+		return nil, err
+	}
+	return &Key{passphrase: passphrase, params: params, derived: make(map[kdfParams][]byte)}, nil
+}
+
+// LoadKey gets the key for a directory from wherever the config says it is, nil means no encryption
+func LoadKey(dir config.DirectoryConfig) (*Key, error) {
+	switch {
+	case dir.PassphraseEnv != "":
+		passphrase, ok := os.LookupEnv(dir.PassphraseEnv)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", dir.PassphraseEnv)
+		}
+		return PassphraseKey([]byte(passphrase))
+	case dir.PassphraseFile != "":
+		b, err := os.ReadFile(dir.PassphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read passphrase file, %s", err)
+		}
+		return PassphraseKey([]byte(strings.TrimRight(string(b), "\r\n")))
+	case dir.PassphrasePrompt:
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, errors.New("can't prompt for a passphrase without a terminal")
+		}
+		fmt.Fprintf(os.Stderr, "Passphrase for %s: ", dir.Dir)
+		passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("could not read passphrase, %s", err)
+		}
+		return PassphraseKey(passphrase)
+	case dir.Encryption != "":
+		return RawKey([]byte(dir.Encryption))
+	}
+	return nil, nil
+}
+
+func (k *Key) Encrypt(file io.ReadCloser) (io.ReadCloser, error) {
+	return newEncryptReader(k, file, defaultChunkSize)
+}
+
+func (k *Key) Decrypt(file io.ReadCloser) (io.ReadCloser, error) {
+	return decrypt(k, file)
+}
+
+// header returns the key derivation part of the header for new files, and the AES key to use with it
+func (k *Key) header() ([]byte, []byte) {
+	if k.raw != nil {
+		return []byte{kdfRaw}, k.raw
+	}
+	header := bytes.NewBuffer([]byte{kdfArgon2id})
+	binary.Write(header, binary.BigEndian, k.params.time)
+	binary.Write(header, binary.BigEndian, k.params.memory)
+	header.WriteByte(k.params.threads)
+	header.Write(k.params.salt[:])
+	return header.Bytes(), k.derive(k.params)
+}
+
+// readHeader reads the key derivation part of a header, returning the bytes read and the AES key
+func (k *Key) readHeader(reader io.Reader) ([]byte, []byte, error) {
+	kdf := make([]byte, 1)
+	if _, err := io.ReadFull(reader, kdf); err != nil {
+		return nil, nil, ErrCorrupt
+	}
+	switch kdf[0] {
+	case kdfRaw:
+		if k.raw == nil {
+			return nil, nil, errors.New("file was encrypted with a raw key, not a passphrase")
+		}
+		return kdf, k.raw, nil
+	case kdfArgon2id:
+		if k.passphrase == nil {
+			return nil, nil, errors.New("file was encrypted with a passphrase, not a raw key")
+		}
+		header := make([]byte, 1+4+4+1+saltSize)
+		header[0] = kdf[0]
+		if _, err := io.ReadFull(reader, header[1:]); err != nil {
+			return nil, nil, ErrCorrupt
+		}
+		var params kdfParams
+		params.time = binary.BigEndian.Uint32(header[1:])
+		params.memory = binary.BigEndian.Uint32(header[5:])
+		params.threads = header[9]
+		copy(params.salt[:], header[10:])
+		if params.time == 0 || params.time > maxArgonTime || params.memory > maxArgonMemory || params.threads == 0 {
+			return nil, nil, ErrCorrupt
+		}
+		return header, k.derive(params), nil
+	}
+	return nil, nil, fmt.Errorf("unsupported key derivation %d", kdf[0])
+}
+
+func (k *Key) derive(params kdfParams) []byte {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if key, ok := k.derived[params]; ok {
+		return key
+	}
+	key := argon2.IDKey(k.passphrase, params.salt[:], params.time, params.memory, params.threads, 32)
+	k.derived[params] = key
+	return key
+}
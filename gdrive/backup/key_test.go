@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPassphraseKey(t *testing.T) {
+	plain := []byte("Hello from a passphrase")
+	writer, err := PassphraseKey([]byte("correct horse battery staple"))
+	require.NoError(t, err)
+	enc, err := writer.Encrypt(io.NopCloser(bytes.NewReader(plain)))
+	require.NoError(t, err)
+	sealed, err := io.ReadAll(enc)
+	require.NoError(t, err)
+
+	// A new key has a different salt, the one in the header must be used
+	reader, err := PassphraseKey([]byte("correct horse battery staple"))
+	require.NoError(t, err)
+	dec, err := reader.Decrypt(io.NopCloser(bytes.NewReader(sealed)))
+	require.NoError(t, err)
+	result, err := io.ReadAll(dec)
+	require.NoError(t, err)
+	require.Equal(t, plain, result)
+
+	wrong, err := PassphraseKey([]byte("incorrect horse"))
+	require.NoError(t, err)
+	_, err = wrong.Decrypt(io.NopCloser(bytes.NewReader(sealed)))
+	require.ErrorIs(t, err, ErrWrongKey)
+
+	_, err = Decrypt([]byte("PPKpKqSMGfX43h2qJbP9cpkn886u9Y2D"), io.NopCloser(bytes.NewReader(sealed)))
+	require.Error(t, err)
+
+	// a header asking for more memory than we allow is turned down before deriving anything
+	greedy := bytes.Clone(sealed)
+	binary.BigEndian.PutUint32(greedy[len(magic)+1+1+4:], maxArgonMemory+1)
+	_, err = reader.Decrypt(io.NopCloser(bytes.NewReader(greedy)))
+	require.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestLoadKey(t *testing.T) {
+	key, err := LoadKey(config.DirectoryConfig{Dir: "/plain"})
+	require.NoError(t, err)
+	require.Nil(t, key)
+
+	_, err = LoadKey(config.DirectoryConfig{Dir: "/short", Encryption: "too short"})
+	require.Error(t, err)
+
+	t.Setenv("TEST_BACKUP_PASSPHRASE", "from the environment")
+	key, err = LoadKey(config.DirectoryConfig{Dir: "/env", PassphraseEnv: "TEST_BACKUP_PASSPHRASE"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("from the environment"), key.passphrase)
+
+	_, err = LoadKey(config.DirectoryConfig{Dir: "/env", PassphraseEnv: "TEST_BACKUP_PASSPHRASE_MISSING"})
+	require.Error(t, err)
+
+	file := filepath.Join(t.TempDir(), "passphrase")
+	require.NoError(t, os.WriteFile(file, []byte("from a file\n"), 0600))
+	key, err = LoadKey(config.DirectoryConfig{Dir: "/file", PassphraseFile: file})
+	require.NoError(t, err)
+	require.Equal(t, []byte("from a file"), key.passphrase)
+}
@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+)
+
+// DefaultMaxDeletes is how many files mirroring will remove in one run when the config doesn't say
+const DefaultMaxDeletes = 100
+
+// Trasher is a Destination that can put files somewhere they can be recovered from, instead of deleting them for good
+type Trasher interface {
+	Trash(item Item) error
+}
+
+var ErrTooManyDeletes = errors.New("too many files to delete")
+
+// FindDeletions returns the files backed up from dir that the source doesn't have any more
+func FindDeletions(dir string, sourceList []Item, backedUp []Item) []Item {
+	return Diff(sourceList, backedUp, dir).Deletions()
+}
+
+// DeleteRemoved removes the deletions from the destination, to the trash unless permanent is set.
+// Nothing is removed if there are more than maxDeletes, as that is more likely a bad listing than a real clear out.
+// It returns the files that were removed.
+func DeleteRemoved(deletions []Item, dst Destination, permanent bool, maxDeletes int) ([]Item, error) {
+	if len(deletions) > maxDeletes {
+		return nil, fmt.Errorf("%w, %d is over the limit of %d", ErrTooManyDeletes, len(deletions), maxDeletes)
+	}
+	trasher, canTrash := dst.(Trasher)
+	if !permanent && !canTrash {
+		return nil, errors.New("destination has no trash, files can only be deleted permanently")
+	}
+
+	var deleted []Item
+	for _, item := range deletions {
+		var err error
+		if permanent {
+			err = dst.Delete(item)
+		} else {
+			err = trasher.Trash(item)
+		}
+		if err != nil {
+			log.Printf("Failed to remove %s: %s", item.Path, err)
+			continue
+		}
+		log.Printf("Removed %s", item.Path)
+		deleted = append(deleted, item)
+	}
+	return deleted, nil
+}
+
+// ClearReplaced removes the backed up items in the way of a type change, to the trash when the destination
+// has one, so a folder isn't replaced as if it were the file taking its place and a file isn't left where a
+// folder is now. It returns what was removed, and the uploads less the ones something is still in the way of.
+func ClearReplaced(replaced, uploads []Item, dst Destination) ([]Item, []Item, []Failure) {
+	trasher, canTrash := dst.(Trasher)
+	var removed []Item
+	stuck := make(map[string]error)
+	for _, item := range replaced {
+		var err error
+		if canTrash {
+			err = trasher.Trash(item)
+		} else {
+			err = dst.Delete(item)
+		}
+		if err != nil {
+			log.Printf("Failed to remove %s, which is in the way: %s", item.Path, err)
+			stuck[NormalizePath(item.Path)] = err
+			continue
+		}
+		log.Printf("Removed %s, which is in the way", item.Path)
+		removed = append(removed, item)
+	}
+	if len(stuck) == 0 {
+		return removed, uploads, nil
+	}
+
+	var clear []Item
+	var blocked []Failure
+	for _, item := range uploads {
+		if err := inTheWay(NormalizePath(item.Path), stuck); err != nil {
+			blocked = append(blocked, Failure{Item: item, Err: err})
+			continue
+		}
+		clear = append(clear, item)
+	}
+	return removed, clear, blocked
+}
+
+// inTheWay is why key can't be uploaded, if it or a folder it is in couldn't be removed
+func inTheWay(key string, stuck map[string]error) error {
+	for parent := key; len(parent) > 1; parent = path.Dir(parent) {
+		if err, ok := stuck[parent]; ok {
+			return fmt.Errorf("%s is in the way, %w", parent, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	modTime := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	src := newMemBackend()
+	src.add("/docs/kept.txt", "kept", modTime)
+	dst := newMemBackend()
+	dst.add("/docs/kept.txt", "kept", modTime)
+	dst.add("/docs/removed.txt", "removed", modTime)
+	dst.add("/docs/old/removed.txt", "removed", modTime)
+	dst.add("/docsother/not-this-dir.txt", "other", modTime)
+	dst.add("/photos/cat.jpg", "other dir", modTime)
+
+	deletions := FindDeletions("/docs", src.listAll(), dst.listAll())
+	require.ElementsMatch(t, []string{"/docs/removed.txt", "/docs/old/removed.txt"}, paths(deletions))
+
+	_, err := DeleteRemoved(deletions, memDestination{dst}, true, 1)
+	require.ErrorIs(t, err, ErrTooManyDeletes)
+	require.Len(t, dst.listAll(), 5)
+
+	_, err = DeleteRemoved(deletions, memDestination{dst}, false, 10)
+	require.Error(t, err, "there is no trash to put things in")
+
+	deleted, err := DeleteRemoved(deletions, memDestination{dst}, true, 10)
+	require.NoError(t, err)
+	require.ElementsMatch(t, paths(deletions), paths(deleted))
+	require.ElementsMatch(t, []string{"/docs/kept.txt", "/docsother/not-this-dir.txt", "/photos/cat.jpg"}, paths(dst.listAll()))
+}
+
+// strictDestination won't delete a folder with anything still in it, like a local disk
+type strictDestination struct{ memDestination }
+
+func (s strictDestination) Delete(item Item) error {
+	for _, other := range s.listAll() {
+		if strings.HasPrefix(other.Path, item.Path+"/") {
+			return errors.New("directory not empty")
+		}
+	}
+	return s.memDestination.Delete(item)
+}
+
+func TestClearReplaced(t *testing.T) {
+	modTime := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	src := newMemBackend()
+	src.add("/docs/report", "a file now", modTime)
+	src.items["/docs/photos"] = Item{Path: "/docs/photos", Name: "photos", Dir: true}
+	src.add("/docs/photos/cat.jpg", "in a folder now", modTime)
+	dst := newMemBackend()
+	dst.items["/docs/report"] = Item{ID: "/docs/report", Path: "/docs/report", Name: "report", Dir: true}
+	dst.add("/docs/report/draft.txt", "was in the folder", modTime)
+	dst.add("/docs/photos", "was a file", modTime)
+
+	plan := Diff(src.listAll(), dst.listAll(), "/docs")
+	require.ElementsMatch(t, []string{"/docs/report", "/docs/photos/cat.jpg"}, paths(plan.Uploads()))
+	require.Empty(t, plan.Deleted, "what was in the folder goes with it")
+	require.Equal(t, []string{"/docs/report/draft.txt", "/docs/report", "/docs/photos"}, paths(plan.Replacements()))
+	require.Equal(t, 2, plan.Files())
+
+	// something in the way that won't go holds back what would go in its place
+	removed, uploads, blocked := ClearReplaced([]Item{dst.items["/docs/report"]}, plan.Uploads(), strictDestination{memDestination{dst}})
+	require.Empty(t, removed)
+	require.Equal(t, []string{"/docs/photos/cat.jpg"}, paths(uploads))
+	require.Len(t, blocked, 1)
+	require.Equal(t, "/docs/report", blocked[0].Item.Path)
+
+	removed, uploads, blocked = ClearReplaced(plan.Replacements(), plan.Uploads(), strictDestination{memDestination{dst}})
+	require.Empty(t, blocked)
+	require.Len(t, removed, 3)
+	require.Empty(t, dst.listAll())
+
+	_, failed := UploadChanges(context.Background(), uploads, memSource{src}, memDestination{dst}, nil, nil, 1)
+	require.Empty(t, failed)
+	require.ElementsMatch(t, []string{"/docs/report", "/docs/photos/cat.jpg"}, paths(dst.listAll()))
+	require.False(t, dst.items["/docs/report"].Dir)
+}
+
+func paths(items []Item) []string {
+	var p []string
+	for _, item := range items {
+		p = append(p, item.Path)
+	}
+	return p
+}
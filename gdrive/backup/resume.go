@@ -0,0 +1,204 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Resumable is a Destination that can carry on with an upload that was cut short, instead of starting it again
+type Resumable interface {
+	PutResumable(item Item, upload *Upload) error
+}
+
+// RangeOpener is a Source that can open a file part way in
+type RangeOpener interface {
+	OpenAt(path string, offset int64) (io.ReadCloser, error)
+}
+
+// UploadSession is a resumable upload that is under way. What the file was is kept too, carrying on
+// with a file that has changed since would give a mix of both versions.
+type UploadSession struct {
+	URI              string
+	Offset           int64  // how much the destination has
+	Header           []byte // the encryption header, resuming needs the same one
+	ModificationTime time.Time
+	Size             int64
+	Hash             string
+	ETag             string
+	// SHA-256 of the start of the file, the mod time and size stay the same through cp -p or rsync -t
+	// and the hash is only there when comparing by hash
+	Fingerprint string
+}
+
+// fingerprintSize is how much of the file goes into UploadSession.Fingerprint
+const fingerprintSize = 1024 * 1024
+
+// SessionStore keeps upload sessions between runs
+type SessionStore interface {
+	Session(key string) (UploadSession, bool)
+	SaveSession(key string, session UploadSession) error
+	DeleteSession(key string) error
+}
+
+// Upload is a file on its way to a destination, which can be read again from any offset
+type Upload struct {
+	item Item
+	src  Source
+	key  *Key
+	// Header is what the file is encrypted under. Start makes a new one, set it from an
+	// UploadSession to carry on from the last attempt.
+	Header []byte
+	// slows down what Open returns, if set
+	Throttle Throttle
+	hashing  *hashingReader // the last read from the start
+}
+
+func NewUpload(item Item, src Source, key *Key) *Upload {
+	return &Upload{item: item, src: src, key: key}
+}
+
+// Start gets ready for a fresh upload
+func (u *Upload) Start() error {
+	if u.key == nil {
+		return nil
+	}
+	header, err := newHeader(u.key, defaultChunkSize)
+	if err != nil {
+		return err
+	}
+	u.Header = header
+	return nil
+}
+
+// Session fills in what the file is now, for a session that is about to start
+func (u *Upload) Session(session UploadSession) (UploadSession, error) {
+	fingerprint, err := u.fingerprint()
+	if err != nil {
+		return UploadSession{}, err
+	}
+	session.ModificationTime, session.Size = u.item.ModificationTime, u.item.Size
+	session.Hash, session.ETag, session.Fingerprint = u.item.Hash, u.item.ETag, fingerprint
+	return session, nil
+}
+
+// Matches says if session was for the file as it is now, so carrying on won't mix two versions of it
+func (u *Upload) Matches(session UploadSession) bool {
+	if !session.ModificationTime.Equal(u.item.ModificationTime) || session.Size != u.item.Size ||
+		session.Hash != u.item.Hash || session.ETag != u.item.ETag || session.Fingerprint == "" {
+		return false
+	}
+	fingerprint, err := u.fingerprint()
+	return err == nil && fingerprint == session.Fingerprint
+}
+
+func (u *Upload) fingerprint() (string, error) {
+	f, err := u.src.Open(u.item.Path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.CopyN(h, f, fingerprintSize)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("could not read %s, %s", u.item.Path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Open returns what gets uploaded, from offset. For encrypted files that means going back to the start
+// of the chunk offset is in, and skipping what comes before it.
+func (u *Upload) Open(offset int64) (io.ReadCloser, error) {
+	reader, err := u.open(offset)
+	if err != nil || u.Throttle == nil {
+		return reader, err
+	}
+	return u.Throttle.Upload(reader), nil
+}
+
+func (u *Upload) open(offset int64) (io.ReadCloser, error) {
+	if u.key == nil {
+		return u.openAt(offset)
+	}
+	if u.Header == nil {
+		return nil, fmt.Errorf("upload of %s hasn't been started", u.item.Path)
+	}
+
+	header, key, chunkSize, _, err := readHeader(u.key, bytes.NewReader(u.Header))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	// chunk 0 comes with the header in front of it
+	sealedSize := int64(chunkSize + aead.Overhead())
+	var chunk, start int64
+	if offset > int64(len(header)) {
+		chunk = (offset - int64(len(header))) / sealedSize
+	}
+	if chunk > 0 {
+		start = int64(len(header)) + chunk*sealedSize
+	}
+	skip := offset - start
+
+	file, err := u.openAt(chunk * int64(chunkSize))
+	if err != nil {
+		return nil, err
+	}
+	reader, err := encryptFrom(u.key, u.Header, file, uint32(chunk))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, reader, skip); err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("could not skip to %d in %s, %s", offset, u.item.Path, err)
+	}
+	return reader, nil
+}
+
+// openAt opens the source file from offset
+func (u *Upload) openAt(offset int64) (io.ReadCloser, error) {
+	f, err := openAt(u.src, u.item.Path, offset)
+	if err != nil {
+		return nil, err
+	}
+	u.hashing = nil
+	if offset == 0 && u.item.Hash == "" {
+		u.hashing = newHashingReader(f)
+		f = u.hashing
+	}
+	if u.Throttle == nil {
+		return f, nil
+	}
+	return u.Throttle.Download(f), nil
+}
+
+// Hash is the file's hash if it was known to start with or the upload read the whole file from the start
+func (u *Upload) Hash() string {
+	if u.item.Hash != "" {
+		return u.item.Hash
+	}
+	return u.hashing.Sum()
+}
+
+// openAt opens the file from offset, reading up to it if the source can't start part way
+func openAt(src Source, filePath string, offset int64) (io.ReadCloser, error) {
+	if opener, ok := src.(RangeOpener); ok && offset > 0 {
+		return opener.OpenAt(filePath, offset)
+	}
+	f, err := src.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, f, offset); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not skip to %d in %s, %s", offset, filePath, err)
+	}
+	return f, nil
+}
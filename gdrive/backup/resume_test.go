@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadOpen(t *testing.T) {
+	plain := make([]byte, 3*defaultChunkSize+1234)
+	rand.New(rand.NewSource(1)).Read(plain)
+	src := newMemBackend()
+	src.add("/docs/big.bin", string(plain), time.Now())
+	item := src.items["/docs/big.bin"]
+
+	key, err := RawKey([]byte("PPKpKqSMGfX43h2qJbP9cpkn886u9Y2D"))
+	require.NoError(t, err)
+	for _, key := range []*Key{nil, key} {
+		upload := NewUpload(item, memSource{src}, key)
+		require.NoError(t, upload.Start())
+		full := readUpload(t, upload, 0)
+
+		// a later run only has the header to go on
+		resumed := NewUpload(item, memSource{src}, key)
+		resumed.Header = upload.Header
+		headerSize := int64(len(upload.Header))
+		sealedSize := int64(defaultChunkSize + 16)
+		for _, offset := range []int64{0, 1, headerSize, headerSize + 1, headerSize + sealedSize - 1, headerSize + sealedSize,
+			headerSize + 2*sealedSize + 100, int64(len(full)) - 1, int64(len(full))} {
+			require.Equal(t, full[offset:], readUpload(t, resumed, offset), "offset %d", offset)
+		}
+
+		if key == nil {
+			require.Equal(t, plain, full)
+			continue
+		}
+		decrypted, err := key.Decrypt(io.NopCloser(bytes.NewReader(full)))
+		require.NoError(t, err)
+		result, err := io.ReadAll(decrypted)
+		require.NoError(t, err)
+		require.Equal(t, plain, result)
+	}
+}
+
+func readUpload(t *testing.T, upload *Upload, offset int64) []byte {
+	reader, err := upload.Open(offset)
+	require.NoError(t, err)
+	defer reader.Close()
+	b, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return b
+}
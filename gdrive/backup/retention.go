@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+)
+
+// Pruner is a Destination that keeps old versions of the files it replaces
+type Pruner interface {
+	PruneVersions(policy config.Retention) (int, error)
+}
+
+// KeepVersions works out which old versions of a file the policy keeps, given the time of each version.
+// The newest KeepLast are kept, then the newest version from each day in the last KeepDaily days and
+// from each month in the last KeepMonthly months.
+func KeepVersions(policy config.Retention, times []time.Time, now time.Time) []bool {
+	order := make([]int, len(times))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool { return times[order[a]].After(times[order[b]]) })
+
+	keep := make([]bool, len(times))
+	days := make(map[string]bool)
+	months := make(map[string]bool)
+	dailyFrom := now.AddDate(0, 0, -policy.KeepDaily)
+	monthlyFrom := now.AddDate(0, -policy.KeepMonthly, 0)
+	for n, i := range order {
+		t := times[i].UTC()
+		if n < policy.KeepLast {
+			keep[i] = true
+		}
+		day := t.Format("2006-01-02")
+		if t.After(dailyFrom) && !days[day] {
+			days[day] = true
+			keep[i] = true
+		}
+		month := t.Format("2006-01")
+		if t.After(monthlyFrom) && !months[month] {
+			months[month] = true
+			keep[i] = true
+		}
+	}
+	return keep
+}
@@ -0,0 +1,32 @@
+package backup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepVersions(t *testing.T) {
+	now := time.Date(2024, 7, 14, 12, 0, 0, 0, time.UTC)
+	times := []time.Time{
+		now.Add(-1 * time.Hour),               // 0 newest
+		now.Add(-2 * time.Hour),               // 1 same day as 0
+		now.AddDate(0, 0, -3),                 // 2 a different day
+		now.AddDate(0, 0, -40),                // 3 too old for daily, newest in its month
+		now.AddDate(0, 0, -41),                // 4 same month as 3
+		now.AddDate(0, -5, 0),                 // 5 newest in its month
+		now.AddDate(-2, 0, 0),                 // 6 too old for anything
+		now.AddDate(0, 0, -3).Add(-time.Hour), // 7 same day as 2
+	}
+
+	keep := KeepVersions(config.Retention{KeepLast: 1, KeepDaily: 30, KeepMonthly: 12}, times, now)
+	require.Equal(t, []bool{true, false, true, true, false, true, false, false}, keep)
+
+	keep = KeepVersions(config.Retention{KeepLast: 3}, times, now)
+	require.Equal(t, []bool{true, true, true, false, false, false, false, false}, keep)
+
+	keep = KeepVersions(config.Retention{}, times, now)
+	require.Equal(t, make([]bool, len(times)), keep)
+}
@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"sync"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/retry"
+)
+
+// Failure is a file that didn't upload and why
+type Failure struct {
+	Item Item
+	Err  error
+}
+
+// Throttle slows down the readers a file goes through on its way to a destination
+type Throttle interface {
+	Download(io.ReadCloser) io.ReadCloser // what is read from the source
+	Upload(io.ReadCloser) io.ReadCloser   // what is sent to the destination
+}
+
+// UploadChanges copies the changed files from the source to the destination, encrypting them if there is a key.
+// It returns the ones that made it, with Hash filled in if it wasn't already and the whole file was read, and
+// the ones that didn't. Once ctx is done no more files are started, they come back as failures with
+// ctx's cause so they aren't lost track of, and throttle, which can be nil, should stop the ones under way.
+func UploadChanges(ctx context.Context, changes []Item, src Source, dst Destination, key *Key, throttle Throttle, numWorkers int) ([]Item, []Failure) {
+	log.Printf("Uploading changes with %d workers", numWorkers)
+
+	// Create a channel to receive upload tasks
+	tasks := make(chan Item, len(changes))
+
+	var uploadedLock sync.Mutex
+	var uploaded []Item
+	var failed []Failure
+
+	// Create a wait group to track worker completion
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+
+	// Start the workers
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for change := range tasks {
+				if ctx.Err() != nil {
+					// not started, it goes back as a failure so the run knows it is left for next time
+					uploadedLock.Lock()
+					failed = append(failed, Failure{Item: change, Err: context.Cause(ctx)})
+					uploadedLock.Unlock()
+					continue
+				}
+				hash, err := upload(change, src, dst, key, throttle)
+				if change.Hash == "" {
+					change.Hash = hash
+				}
+				uploadedLock.Lock()
+				if err != nil {
+					log.Printf("Failed to upload %s: %s", change.Path, err)
+					failed = append(failed, Failure{Item: change, Err: err})
+				} else {
+					log.Printf("Uploaded %s", change.Name)
+					uploaded = append(uploaded, change)
+				}
+				uploadedLock.Unlock()
+			}
+		}()
+	}
+
+	// Send the upload tasks to the channel
+	for _, change := range changes {
+		tasks <- change
+	}
+	close(tasks)
+
+	// Wait for all workers to finish
+	wg.Wait()
+	return uploaded, failed
+}
+
+// RetryFailures has another go at the uploads that failed with an error that could go away, one at a time
+// and backing off between tries. It returns the ones that made it this time and the ones that still didn't.
+func RetryFailures(ctx context.Context, failures []Failure, src Source, dst Destination, key *Key, throttle Throttle, policy retry.Policy) ([]Item, []Failure) {
+	var uploaded []Item
+	var failed []Failure
+	for _, failure := range failures {
+		if ctx.Err() != nil {
+			failed = append(failed, failure) // the run is over, it is left for next time
+			continue
+		}
+		if !retry.Retryable(failure.Err) {
+			log.Printf("Not retrying %s, %s", failure.Item.Path, failure.Err)
+			failed = append(failed, failure)
+			continue
+		}
+		log.Printf("Retrying %s", failure.Item.Path)
+		item := failure.Item
+		err := retry.Do(ctx, policy, func() error {
+			hash, err := upload(item, src, dst, key, throttle)
+			if item.Hash == "" {
+				item.Hash = hash
+			}
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to upload %s again: %s", failure.Item.Path, err)
+			failed = append(failed, Failure{Item: failure.Item, Err: err})
+			continue
+		}
+		log.Printf("Uploaded %s", item.Name)
+		uploaded = append(uploaded, item)
+	}
+	return uploaded, failed
+}
+
+// upload makes sure the folder is there and puts the file in it, returning the file's hash if it was worked out
+func upload(item Item, src Source, dst Destination, key *Key, throttle Throttle) (string, error) {
+	err := dst.EnsureFolder(path.Dir(item.Path))
+	if err != nil {
+		return "", fmt.Errorf("failed to create folder: %w", err)
+	}
+	return put(item, src, dst, key, throttle)
+}
+
+// put sends one file to the destination, resuming an earlier attempt if the destination can. Files without
+// a hash are hashed on the way, unless the upload carried on from part way through.
+func put(item Item, src Source, dst Destination, key *Key, throttle Throttle) (string, error) {
+	if resumable, ok := dst.(Resumable); ok {
+		upload := NewUpload(item, src, key)
+		upload.Throttle = throttle
+		err := resumable.PutResumable(item, upload)
+		return upload.Hash(), err
+	}
+
+	f, err := src.Open(item.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file for download: %w", err)
+	}
+	var hashing *hashingReader
+	if item.Hash == "" {
+		hashing = newHashingReader(f)
+		f = hashing
+	}
+	if throttle != nil {
+		f = throttle.Download(f)
+	}
+	if key != nil {
+		encrypted, err := key.Encrypt(f)
+		if err != nil {
+			f.Close()
+			return "", fmt.Errorf("failed to encrypt file: %s", err)
+		}
+		f = encrypted
+	}
+	if throttle != nil {
+		f = throttle.Upload(f)
+	}
+	err = dst.Put(item, f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	return hashing.Sum(), nil
+}
@@ -0,0 +1,202 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/retry"
+	"github.com/stretchr/testify/require"
+)
+
+// memBackend keeps files in memory, memSource and memDestination put the Source and Destination interfaces on it
+type memBackend struct {
+	lock  sync.Mutex
+	items map[string]Item
+	data  map[string][]byte
+}
+
+func newMemBackend() *memBackend {
+	return &memBackend{items: make(map[string]Item), data: make(map[string][]byte)}
+}
+
+func (m *memBackend) add(filePath, content string, modTime time.Time) {
+	m.items[filePath] = Item{ID: filePath, Path: filePath, Name: filePath[strings.LastIndex(filePath, "/")+1:], ModificationTime: modTime}
+	m.data[filePath] = []byte(content)
+}
+
+func (m *memBackend) list(dir string) ([]Item, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var items []Item
+	for _, item := range m.items {
+		if strings.HasPrefix(item.Path, dir) {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+type memSource struct{ *memBackend }
+
+func (m memSource) List(dir string) ([]Item, error) {
+	return m.list(dir)
+}
+
+func (m *memBackend) Stat(filePath string) (Item, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.items[filePath], nil
+}
+
+func (m *memBackend) Open(filePath string) (io.ReadCloser, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return io.NopCloser(bytes.NewReader(m.data[filePath])), nil
+}
+
+type memDestination struct{ *memBackend }
+
+func (m memDestination) List() ([]Item, error) {
+	return m.list("")
+}
+
+func (m *memBackend) EnsureFolder(string) error {
+	return nil
+}
+
+func (m *memBackend) Put(item Item, reader io.Reader) error {
+	b, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	item.ID = item.Path
+	m.items[item.Path] = item
+	m.data[item.Path] = b
+	return nil
+}
+
+func (m *memBackend) Delete(item Item) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.items, item.Path)
+	delete(m.data, item.Path)
+	return nil
+}
+
+func (m *memBackend) Get(item Item) (io.ReadCloser, error) {
+	return m.Open(item.Path)
+}
+
+func (m *memBackend) listAll() []Item {
+	items, _ := m.list("")
+	return items
+}
+
+func TestUploadChanges(t *testing.T) {
+	modTime := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	src := newMemBackend()
+	src.add("/docs/a.txt", "first file", modTime)
+	src.add("/docs/sub/b.txt", "second file", modTime)
+	dst := newMemBackend()
+
+	key, err := RawKey([]byte("PPKpKqSMGfX43h2qJbP9cpkn886u9Y2D"))
+	require.NoError(t, err)
+	changes := FindChanges(src.listAll(), dst.listAll())
+	require.Len(t, changes, 2)
+	uploaded, failed := UploadChanges(context.Background(), changes, memSource{src}, memDestination{dst}, key, nil, 2)
+	require.Empty(t, failed)
+	require.ElementsMatch(t, []string{"/docs/a.txt", "/docs/sub/b.txt"}, paths(uploaded))
+	for _, item := range uploaded {
+		// worked out on the way up rather than reading the file twice
+		hash, err := HashFile(memSource{src}, item.Path)
+		require.NoError(t, err)
+		require.Equal(t, hash, item.Hash, item.Path)
+	}
+
+	require.Empty(t, FindChanges(src.listAll(), dst.listAll()))
+	stored, err := dst.Get(Item{Path: "/docs/sub/b.txt"})
+	require.NoError(t, err)
+	decrypted, err := key.Decrypt(stored)
+	require.NoError(t, err)
+	result, err := io.ReadAll(decrypted)
+	require.NoError(t, err)
+	require.Equal(t, "second file", string(result))
+}
+
+// flakyDestination turns down puts with the error set for each path, until it has done so that many times
+type flakyDestination struct {
+	memDestination
+	lock  sync.Mutex
+	errs  map[string]error
+	times map[string]int
+}
+
+func (f *flakyDestination) Put(item Item, reader io.Reader) error {
+	f.lock.Lock()
+	if f.times[item.Path] > 0 {
+		f.times[item.Path]--
+		f.lock.Unlock()
+		return f.errs[item.Path]
+	}
+	f.lock.Unlock()
+	return f.memDestination.Put(item, reader)
+}
+
+func TestUploadChangesStopped(t *testing.T) {
+	modTime := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	src := newMemBackend()
+	src.add("/docs/a.txt", "first file", modTime)
+	src.add("/docs/b.txt", "second file", modTime)
+	dst := newMemBackend()
+
+	closed := errors.New("the upload window has closed")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(closed)
+	uploaded, failed := UploadChanges(ctx, src.listAll(), memSource{src}, memDestination{dst}, nil, nil, 2)
+	require.Empty(t, uploaded)
+	require.Len(t, failed, 2, "what wasn't started is still accounted for")
+	for _, failure := range failed {
+		require.ErrorIs(t, failure.Err, closed)
+	}
+	require.Empty(t, dst.listAll())
+
+	_, failed = RetryFailures(ctx, failed, memSource{src}, memDestination{dst}, nil, nil, retry.Default)
+	require.Len(t, failed, 2)
+}
+
+func TestRetryFailures(t *testing.T) {
+	modTime := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	src := newMemBackend()
+	src.add("/blip.txt", "comes good", modTime)
+	src.add("/busy.txt", "comes good later", modTime)
+	src.add("/denied.txt", "never goes", modTime)
+	dst := &flakyDestination{
+		memDestination: memDestination{newMemBackend()},
+		errs: map[string]error{
+			"/blip.txt":   &retry.StatusError{StatusCode: http.StatusServiceUnavailable},
+			"/busy.txt":   &retry.StatusError{StatusCode: http.StatusTooManyRequests},
+			"/denied.txt": errors.New("permission denied"),
+		},
+		times: map[string]int{"/blip.txt": 1, "/busy.txt": 3, "/denied.txt": 100},
+	}
+
+	uploaded, failed := UploadChanges(context.Background(), src.listAll(), memSource{src}, dst, nil, nil, 2)
+	require.Empty(t, uploaded)
+	require.Len(t, failed, 3)
+
+	policy := retry.Policy{Attempts: 3, Base: time.Millisecond, Max: time.Millisecond}
+	uploaded, failed = RetryFailures(context.Background(), failed, memSource{src}, dst, nil, nil, policy)
+	require.ElementsMatch(t, []string{"/blip.txt", "/busy.txt"}, paths(uploaded))
+	require.Len(t, failed, 1)
+	require.Equal(t, "/denied.txt", failed[0].Item.Path)
+	require.Equal(t, 99, dst.times["/denied.txt"], "permanent errors aren't tried again")
+}
@@ -2,30 +2,189 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 )
 
-type config struct {
-	Directories      []DirectoryConfig `json:"directories"`
-	GoogleBaseFolder string            `json:"googleBaseFolder"`
+// Config is what is in config.json
+type Config struct {
+	Directories      []DirectoryConfig   `json:"directories"`
+	GoogleBaseFolder string              `json:"googleBaseFolder"` // for google destinations without a baseFolder
+	Destinations     []DestinationConfig `json:"destinations"`     // google drive on its own if not set
+	Retention        *Retention          `json:"retention"`        // keep replaced files as old versions, for as long as this says
+	// Where to remember what has been backed up, so destinations only need listing in full every ReconcileDays
+	StateFile     string `json:"stateFile"`
+	ReconcileDays int    `json:"reconcileDays"` // 7 if not set
+	// Where to keep big uploads that are under way, so they carry on from where they got to if they are cut short
+	ResumeFile string `json:"resumeFile"`
+	Limits     Limits `json:"limits"` // for the whole run, each directory can have its own as well
+	// When uploads can run. The rate of the window we are in replaces Limits, and a run stops
+	// when it gets to a time outside all of them. Any time is fine if there are none.
+	Schedule []Window `json:"schedule"`
+	// Where to write what a backup run did as JSON, for monitoring. Runs also exit 0 if everything
+	// worked, 2 if some files failed and 1 if the run couldn't go on.
+	ReportFile string `json:"reportFile"`
+	// Held while a run is going so two never overlap, the daemon holds it for as long as it is up
+	LockFile string `json:"lockFile"`
+	// When the daemon backs up directories that don't have a cron of their own, @daily if not set
+	Cron string `json:"cron"`
+}
+
+// Limits is how fast files can be read from the source and sent to the destination, 0 is as fast as it goes
+type Limits struct {
+	UploadKBps   int `json:"uploadKBps"`
+	DownloadKBps int `json:"downloadKBps"`
+}
+
+// Window is a time of day uploads can run in, like 01:00 to 06:00. It goes over midnight if End is before Start.
+type Window struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Limits
+}
+
+// Retention is how many old versions of a file to keep
+type Retention struct {
+	KeepLast    int `json:"keepLast"`
+	KeepDaily   int `json:"keepDaily"`   // one a day for this many days
+	KeepMonthly int `json:"keepMonthly"` // one a month for this many months
+}
+
+const (
+	SourceNextcloud = "nextcloud"
+	SourceLocal     = "local"
+
+	MirrorTrash  = "trash"
+	MirrorDelete = "delete"
+
+	CompareModTime = "mtime"
+	CompareHash    = "hash"
+)
+
+const (
+	DestinationGoogle = "gdrive"
+	DestinationLocal  = "local"
+	DestinationWebDAV = "webdav"
+	DestinationS3     = "s3"
+)
+
+// DestinationConfig is one place backups are copied to, every run copies to each of them
+type DestinationConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// The folder backups go in, or the key prefix for s3. gdrive uses baseFolder.
+	Path     string `json:"path"`
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// S3 compatible storage, Address is the endpoint
+	Bucket     string `json:"bucket"`
+	Region     string `json:"region"`
+	AccessKey  string `json:"accessKey"`
+	SecretKey  string `json:"secretKey"`
+	PartSizeMB int    `json:"partSizeMB"` // files bigger than this are uploaded in parts, for s3 and gdrive
+	// gdrive signs in with this service account key instead of token.json, acting as
+	// Subject through domain-wide delegation if it is set
+	ServiceAccountKey string `json:"serviceAccountKey"`
+	Subject           string `json:"subject"`
+	// the folder ID gdrive backs up into, googleBaseFolder if it isn't set
+	BaseFolder string `json:"baseFolder"`
+	// the Shared Drive the base folder is in, backups go in the top of it without a base folder
+	DriveID string `json:"driveId"`
 }
 
 type DirectoryConfig struct {
 	Dir        string
-	Encryption string
+	Source     string // where Dir is, nextcloud if not set
+	Encryption string // a raw AES key, use one of the passphrase options instead for new backups
+	// Where to get the passphrase the encryption key is derived from
+	PassphraseEnv    string
+	PassphraseFile   string
+	PassphrasePrompt bool
+	// Remove backed up files that have gone from the source, by moving them to the trash or deleting them
+	Mirror           string
+	MirrorMaxDeletes int // the most files one run will remove, 0 uses the default
+	// How to tell a file has changed, mtime (the default) or hash to compare contents.
+	// Hashes are kept on gdrive and s3, other destinations still compare modification times.
+	Compare string
+	Limits  Limits // on top of the ones for the whole run
+	Cron    string // when the daemon backs this directory up, like "30 2 * * *" or "@every 6h"
+}
+
+func ReadConfig(dir string) Config {
+	c, err := Load(dir)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	return c
 }
 
-func ReadConfig(dir string) config {
+// Load reads the config, for when a bad one shouldn't stop everything
+func Load(dir string) (Config, error) {
 	f, err := os.Open(dir)
 	if err != nil {
-		log.Fatalf("could not read config, %s", err)
+		return Config{}, fmt.Errorf("could not read config, %s", err)
 	}
 	defer f.Close()
-	var c config
+	var c Config
 	err = json.NewDecoder(f).Decode(&c)
 	if err != nil {
-		log.Fatalf("could not read config, %s", err)
+		return Config{}, fmt.Errorf("could not read config, %s", err)
 	}
-	return c
+	err = c.validate()
+	if err != nil {
+		return Config{}, fmt.Errorf("bad config, %s", err)
+	}
+	return c, nil
+}
+
+// validate catches the mistakes that would otherwise only show part way through a run
+func (c Config) validate() error {
+	if r := c.Retention; r != nil {
+		if r.KeepLast < 0 || r.KeepDaily < 0 || r.KeepMonthly < 0 {
+			return fmt.Errorf("retention can't keep a negative number of versions")
+		}
+		// keeping none would prune every old version as soon as it was made
+		if r.KeepLast == 0 && r.KeepDaily == 0 && r.KeepMonthly == 0 {
+			return fmt.Errorf("retention needs at least one of keepLast, keepDaily or keepMonthly")
+		}
+	}
+	for _, dir := range c.Directories {
+		// the paths are kept from the root, so a relative one would never match what was backed up
+		if dir.SourceType() == SourceLocal && !filepath.IsAbs(dir.Dir) {
+			return fmt.Errorf("%s needs to be an absolute path", dir.Dir)
+		}
+		if dir.Compare != "" && dir.Compare != CompareModTime && dir.Compare != CompareHash {
+			return fmt.Errorf("unknown compare %s for %s, expected %s or %s", dir.Compare, dir.Dir, CompareModTime, CompareHash)
+		}
+		if dir.Mirror != "" && dir.Mirror != MirrorTrash && dir.Mirror != MirrorDelete {
+			return fmt.Errorf("unknown mirror %s for %s, expected %s or %s", dir.Mirror, dir.Dir, MirrorTrash, MirrorDelete)
+		}
+		if dir.Mirror == MirrorTrash {
+			// only google drive has a trash, the others can only delete for good
+			for _, dst := range c.DestinationList() {
+				if dst.Type != DestinationGoogle {
+					return fmt.Errorf("%s mirrors to the trash, but destination %s has no trash, use %s instead", dir.Dir, dst.Type, MirrorDelete)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (d DirectoryConfig) SourceType() string {
+	if d.Source == "" {
+		return SourceNextcloud
+	}
+	return d.Source
+}
+
+// DestinationList gives the configured destinations, falling back to google drive for configs from before there was a choice
+func (c Config) DestinationList() []DestinationConfig {
+	if len(c.Destinations) > 0 {
+		return c.Destinations
+	}
+	return []DestinationConfig{{Name: DestinationGoogle, Type: DestinationGoogle}}
 }
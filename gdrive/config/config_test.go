@@ -0,0 +1,42 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load(writeConfig(t, `{"directories": [{"dir": "/docs", "source": "local"}, {"dir": "photos"}]}`))
+	require.NoError(t, err)
+	require.Len(t, c.Directories, 2)
+
+	_, err = Load(writeConfig(t, `{"directories": [{"dir": "docs", "source": "local"}]}`))
+	require.ErrorContains(t, err, "absolute")
+	_, err = Load(writeConfig(t, `{"directories": [{"dir": "/docs", "mirror": "yes"}]}`))
+	require.ErrorContains(t, err, "unknown mirror yes")
+	_, err = Load(writeConfig(t, `{"directories": [{"dir": "/docs", "compare": "size"}]}`))
+	require.ErrorContains(t, err, "unknown compare size")
+
+	_, err = Load(writeConfig(t, `{"directories": [{"dir": "/docs", "mirror": "trash"}]}`))
+	require.NoError(t, err, "google drive has a trash")
+	_, err = Load(writeConfig(t, `{"directories": [{"dir": "/docs", "mirror": "trash"}],
+		"destinations": [{"type": "gdrive"}, {"type": "local", "path": "/mnt/backup"}]}`))
+	require.ErrorContains(t, err, "has no trash")
+
+	c, err = Load(writeConfig(t, `{"retention": {"keepDaily": 7}}`))
+	require.NoError(t, err)
+	require.Equal(t, 7, c.Retention.KeepDaily)
+	_, err = Load(writeConfig(t, `{"retention": {}}`))
+	require.ErrorContains(t, err, "at least one")
+	_, err = Load(writeConfig(t, `{"retention": {"keepLast": 3, "keepDaily": -1}}`))
+	require.ErrorContains(t, err, "negative")
+}
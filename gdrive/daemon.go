@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/report"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/state"
+	"github.com/robfig/cron/v3"
+)
+
+const defaultCron = "@daily"
+
+// runDaemon stays up backing each directory up on its own cron, until it is told to stop.
+// SIGHUP reads the config again and swaps the jobs over once any run going has finished.
+func runDaemon(s *setup) {
+	if s.conf.LockFile == "" {
+		log.Printf("No lockFile in the config, nothing stops a backup started by hand running alongside the daemon")
+	} else {
+		// held for as long as we are up, changing lockFile needs a restart
+		lock, err := state.TryLock(s.conf.LockFile)
+		if err != nil {
+			log.Fatalf("Could not start the daemon, %s", err)
+		}
+		defer lock.Unlock()
+	}
+
+	// one run at a time, a directory whose turn comes up during another's run waits for it
+	var running sync.Mutex
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.PrintfLogger(log.Default()))))
+	entries, err := scheduleJobs(c, s, &running)
+	if err != nil {
+		log.Fatalf("Could not start the daemon, %s", err)
+	}
+	c.Start()
+	log.Printf("Daemon started with %d directories", len(entries))
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Printf("Stopping once the run going has finished")
+			<-c.Stop().Done()
+			return
+		}
+
+		log.Printf("Reloading %s", configPath)
+		// the state and upload sessions are read again, so wait for a run going to save its own first
+		running.Lock()
+		reloaded, err := reload()
+		if err != nil {
+			running.Unlock()
+			log.Printf("Keeping the old config, %s", err)
+			continue
+		}
+		for _, id := range entries {
+			c.Remove(id)
+		}
+		entries, err = scheduleJobs(c, reloaded, &running)
+		if err != nil {
+			// checked before anything was removed, so this shouldn't happen
+			log.Printf("Could not schedule the new config, %s", err)
+		}
+		s = reloaded
+		reportFile = s.conf.ReportFile
+		running.Unlock()
+		log.Printf("Reloaded, %d directories scheduled", len(entries))
+	}
+}
+
+// reload reads and connects up the config again
+func reload() (*setup, error) {
+	conf, err := config.Load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range conf.Directories {
+		if _, err := cron.ParseStandard(dirCron(conf, dir)); err != nil {
+			return nil, fmt.Errorf("bad cron for %s, %s", dir.Dir, err)
+		}
+	}
+	s, err := newSetup(conf)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// scheduleJobs adds a job for each directory, each run writes its own report
+func scheduleJobs(c *cron.Cron, s *setup, running *sync.Mutex) ([]cron.EntryID, error) {
+	var entries []cron.EntryID
+	for _, dir := range s.conf.Directories {
+		id, err := c.AddFunc(dirCron(s.conf, dir), func() {
+			running.Lock()
+			defer running.Unlock()
+			log.Printf("*** backing up %s ***", dir.Dir)
+			rep = report.New(time.Now())
+			s.backup([]config.DirectoryConfig{dir})
+			finishReport()
+		})
+		if err != nil {
+			for _, id := range entries {
+				c.Remove(id)
+			}
+			return nil, fmt.Errorf("bad cron for %s, %s", dir.Dir, err)
+		}
+		entries = append(entries, id)
+	}
+	return entries, nil
+}
+
+func dirCron(conf config.Config, dir config.DirectoryConfig) string {
+	switch {
+	case dir.Cron != "":
+		return dir.Cron
+	case conf.Cron != "":
+		return conf.Cron
+	}
+	return defaultCron
+}
@@ -0,0 +1,204 @@
+package gdrive
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// fakeGoogle hands out a code for a challenge and swaps it for a token if the verifier matches
+func fakeGoogle(t *testing.T) *oauth2.Config {
+	challenges := map[string]string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		require.Equal(t, "S256", query.Get("code_challenge_method"))
+		challenges["the-code"] = query.Get("code_challenge")
+		redirect, _ := url.Parse(query.Get("redirect_uri"))
+		redirect.RawQuery = url.Values{"code": {"the-code"}, "state": {query.Get("state")}}.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	polls := 0
+	mux.HandleFunc("/device/code", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// how google sends it, verification_url rather than verification_uri
+		json.NewEncoder(w).Encode(map[string]any{"device_code": "the-device", "user_code": "ABCD-EFGH",
+			"verification_url": "https://www.google.com/device", "expires_in": 60, "interval": 1})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		if r.Form.Get("grant_type") == "refresh_token" {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Form.Get("refresh_token") == "revoked" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`))
+				return
+			}
+			// google doesn't send the refresh token again
+			json.NewEncoder(w).Encode(map[string]any{"access_token": "refreshed", "token_type": "Bearer", "expires_in": 3600})
+			return
+		}
+		if r.Form.Get("grant_type") == "urn:ietf:params:oauth:grant-type:device_code" {
+			require.Equal(t, "the-device", r.Form.Get("device_code"))
+			w.Header().Set("Content-Type", "application/json")
+			polls++
+			if polls == 1 {
+				// not entered the code yet
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"authorization_pending"}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600})
+			return
+		}
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(sum[:]) != challenges[r.Form.Get("code")] {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "refresh_token": "refresh", "token_type": "Bearer", "expires_in": 3600})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{AuthURL: server.URL + "/auth", TokenURL: server.URL + "/token", DeviceAuthURL: server.URL + "/device/code"},
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	config := fakeGoogle(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the browser, following the link through to the redirect
+	token, err := Authorize(ctx, config, func(authURL string) {
+		go func() {
+			resp, err := http.Get(authURL)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	})
+	require.NoError(t, err)
+	require.Equal(t, "access", token.AccessToken)
+	require.Equal(t, "refresh", token.RefreshToken)
+	require.Empty(t, config.RedirectURL, "the caller's config is left alone")
+}
+
+func TestAuthorizeWrongState(t *testing.T) {
+	config := fakeGoogle(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var status int
+	_, err := Authorize(ctx, config, func(authURL string) {
+		link, _ := url.Parse(authURL)
+		redirect, _ := url.Parse(link.Query().Get("redirect_uri"))
+		redirect.RawQuery = url.Values{"code": {"the-code"}, "state": {"state-token"}}.Encode()
+		resp, err := http.Get(redirect.String())
+		require.NoError(t, err)
+		resp.Body.Close()
+		status = resp.StatusCode
+	})
+	require.Equal(t, http.StatusBadRequest, status)
+	require.ErrorIs(t, err, context.DeadlineExceeded, "a code with someone else's state is never used")
+}
+
+func TestAuthorizeDevice(t *testing.T) {
+	config := fakeGoogle(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var shown []string
+	token, err := AuthorizeDevice(ctx, config, func(userCode, verificationURL string) {
+		shown = []string{userCode, verificationURL}
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"ABCD-EFGH", "https://www.google.com/device"}, shown)
+	require.Equal(t, "refresh", token.RefreshToken)
+}
+
+func TestSavingTokenSource(t *testing.T) {
+	config := fakeGoogle(t)
+	path := filepath.Join(t.TempDir(), "token.json")
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Hour)}
+	source := &savingTokenSource{base: config.TokenSource(context.Background(), expired), path: path, last: "old"}
+
+	token, err := source.Token()
+	require.NoError(t, err)
+	require.Equal(t, "refreshed", token.AccessToken)
+	saved, err := tokenFromFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "refreshed", saved.AccessToken)
+	require.Equal(t, "refresh", saved.RefreshToken, "the refresh token is kept")
+
+	revoked := &oauth2.Token{AccessToken: "old", RefreshToken: "revoked", Expiry: time.Now().Add(-time.Hour)}
+	source = &savingTokenSource{base: config.TokenSource(context.Background(), revoked), path: path, last: "old"}
+	_, err = source.Token()
+	require.ErrorIs(t, err, ErrReauthorize)
+	saved, err = tokenFromFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "refreshed", saved.AccessToken, "the token file is left alone")
+}
+
+func TestServiceAccountClient(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	var claims map[string]any
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		require.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.Form.Get("grant_type"))
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		require.Len(t, parts, 3)
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(payload, &claims))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "service-token", "token_type": "Bearer", "expires_in": 3600})
+	}))
+	defer tokens.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer service-token", r.Header.Get("Authorization"))
+	}))
+	defer api.Close()
+
+	keyFile, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "backup@project.iam.gserviceaccount.com",
+		"private_key_id": "1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokens.URL,
+	})
+	require.NoError(t, err)
+	client, err := serviceAccountClient(keyFile, "someone@example.com")
+	require.NoError(t, err)
+	resp, err := client.Get(api.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "backup@project.iam.gserviceaccount.com", claims["iss"])
+	require.Equal(t, "someone@example.com", claims["sub"], "acting as the delegated user")
+	require.Equal(t, Scope, claims["scope"])
+}
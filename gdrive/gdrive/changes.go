@@ -0,0 +1,91 @@
+package gdrive
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+)
+
+const changeFields = "nextPageToken, newStartPageToken, changes(removed, fileId, file(id, name, mimeType, parents, modifiedTime, size, trashed, appProperties))"
+
+// StartToken returns where the next Changes call should start from, take it before listing so nothing is missed
+func (c *Client) StartToken() (string, error) {
+	r, err := c.startTokenCall().Do()
+	if err != nil {
+		return "", fmt.Errorf("unable to get the changes start token: %w", err)
+	}
+	return r.StartPageToken, nil
+}
+
+// Changes returns what has changed in the base folder since token: files and folders that were added
+// or changed, the IDs of ones that have gone, and the token to use next time.
+func (c *Client) Changes(token string) ([]backup.Item, []string, string, error) {
+	var changed []backup.Item
+	var removed []string
+	for {
+		r, err := c.changesCall(token).Spaces("drive").IncludeRemoved(true).PageSize(1000).Fields(changeFields).Do()
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("unable to list changes: %w", err)
+		}
+		for _, change := range r.Changes {
+			file := change.File
+			if change.Removed || file == nil || file.Trashed || len(file.Parents) == 0 {
+				removed = append(removed, change.FileId)
+				continue
+			}
+			folderPath, inBase, err := c.pathInBase(file.Parents[0])
+			if err != nil {
+				return nil, nil, "", err
+			}
+			if !inBase || folderPath == "/"+versionsFolder || strings.HasPrefix(folderPath, "/"+versionsFolder+"/") ||
+				(folderPath == "" && file.Name == versionsFolder) {
+				// not part of the backup, or moved out of it into the versions
+				removed = append(removed, change.FileId)
+				continue
+			}
+			item, err := toItem(file, folderPath)
+			if err != nil {
+				return nil, nil, "", err
+			}
+			changed = append(changed, item)
+		}
+
+		if r.NewStartPageToken != "" {
+			return changed, removed, r.NewStartPageToken, nil
+		}
+		token = r.NextPageToken
+	}
+}
+
+// pathInBase works out the path of a folder, and whether it is in the base folder at all
+func (c *Client) pathInBase(folderID string) (string, bool, error) {
+	if folderID == c.baseFolder {
+		return "", true, nil
+	}
+	// the cache is shared with listings and uploads, the lock isn't held while drive is asked
+	c.folderLock.Lock()
+	fullPath, ok := c.FolderIDs[folderID]
+	c.folderLock.Unlock()
+	if ok {
+		return fullPath, true, nil
+	}
+	var names []string
+	id := folderID
+	for id != c.baseFolder {
+		folder, err := c.GetFolderByID(id)
+		if err != nil {
+			return "", false, err
+		}
+		if len(folder.Parents) == 0 {
+			return "", false, nil // reached the top without passing the base folder
+		}
+		names = append([]string{folder.Name}, names...)
+		id = folder.Parents[0]
+	}
+	fullPath = "/" + strings.Join(names, "/")
+	c.folderLock.Lock()
+	c.FolderIDs[folderID] = fullPath
+	c.folderLock.Unlock()
+	return fullPath, true, nil
+}
@@ -0,0 +1,170 @@
+package gdrive
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"google.golang.org/api/drive/v3"
+)
+
+// List returns everything in the base folder as backup items, so the client can be used as a backup.Destination.
+// Paths are worked out from the folders in the listing, without asking drive about each one.
+func (c *Client) List() ([]backup.Item, error) {
+	files, err := c.ListFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	folders := make(map[string]*drive.File)
+	for _, file := range files {
+		if file.MimeType == "application/vnd.google-apps.folder" {
+			folders[file.Id] = file
+		}
+	}
+	paths := map[string]string{c.baseFolder: ""}
+	var folderPath func(folderID string) (string, error)
+	folderPath = func(folderID string) (string, error) {
+		if p, ok := paths[folderID]; ok {
+			return p, nil
+		}
+		folder, ok := folders[folderID]
+		if !ok || len(folder.Parents) == 0 {
+			return "", fmt.Errorf("folder %s is not in the listing", folderID)
+		}
+		parentPath, err := folderPath(folder.Parents[0])
+		if err != nil {
+			return "", err
+		}
+		paths[folderID] = parentPath + "/" + folder.Name
+		return paths[folderID], nil
+	}
+
+	var items []backup.Item
+	for _, file := range files {
+		if len(file.Parents) == 0 {
+			continue
+		}
+		filePath, err := folderPath(file.Parents[0])
+		if err != nil {
+			return nil, fmt.Errorf("when getting the full path for %s, got error %w", file.Name, err)
+		}
+
+		item, err := toItem(file, filePath)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	// keep the paths, so uploads and changes don't have to look the folders up again
+	c.folderLock.Lock()
+	for folderID, folderPath := range paths {
+		if folderID != c.baseFolder {
+			c.FolderIDs[folderID] = folderPath
+			c.Folders[strings.Trim(folderPath, "/")] = folderID
+		}
+	}
+	c.folderLock.Unlock()
+
+	log.Printf("Got %d items", len(items))
+	return items, nil
+}
+
+// toItem turns a drive file in folderPath into a backup item
+func toItem(file *drive.File, folderPath string) (backup.Item, error) {
+	parsedTime, err := time.Parse(time.RFC3339, file.ModifiedTime)
+	if err != nil {
+		return backup.Item{}, fmt.Errorf("failed to parse time for %s, %s", folderPath+"/"+file.Name, err)
+	}
+	return backup.Item{
+		ID:               file.Id,
+		Path:             folderPath + "/" + file.Name,
+		ModificationTime: parsedTime,
+		Dir:              file.MimeType == "application/vnd.google-apps.folder",
+		Name:             file.Name,
+		Size:             file.Size,
+		Hash:             file.AppProperties[hashProperty],
+		ETag:             file.AppProperties[etagProperty],
+	}, nil
+}
+
+func (c *Client) EnsureFolder(folderPath string) error {
+	_, err := c.GetFolder(folderPath)
+	return err
+}
+
+func (c *Client) Put(item backup.Item, reader io.Reader) error {
+	return c.UploadFile(File{
+		Name:         item.Name,
+		Path:         item.Path,
+		Reader:       io.NopCloser(reader),
+		ModifiedTime: item.ModificationTime,
+		Hash:         item.Hash,
+		ETag:         item.ETag,
+	})
+}
+
+func (c *Client) Delete(item backup.Item) error {
+	id, err := c.fileID(item)
+	if err != nil {
+		return err
+	}
+	return c.DeleteFile(id)
+}
+
+func (c *Client) Trash(item backup.Item) error {
+	id, err := c.fileID(item)
+	if err != nil {
+		return err
+	}
+	return c.TrashFile(id)
+}
+
+// Retag updates the hash, ETag and modification time kept with the file, without uploading it again
+func (c *Client) Retag(item backup.Item) error {
+	id, err := c.fileID(item)
+	if err != nil {
+		return err
+	}
+	_, err = c.updateCall(id, &drive.File{
+		ModifiedTime:  item.ModificationTime.Format(time.RFC3339),
+		AppProperties: map[string]string{hashProperty: item.Hash, etagProperty: item.ETag},
+	}).Do()
+	if err != nil {
+		return fmt.Errorf("error updating %s: %w", item.Path, err)
+	}
+	return nil
+}
+
+func (c *Client) Get(item backup.Item) (io.ReadCloser, error) {
+	id, err := c.fileID(item)
+	if err != nil {
+		return nil, err
+	}
+	return c.DownloadFile(id)
+}
+
+// fileID looks the file up by path when the item doesn't have an ID, which happens
+// for files remembered from an upload rather than from a listing
+func (c *Client) fileID(item backup.Item) (string, error) {
+	if item.ID != "" {
+		return item.ID, nil
+	}
+	folderID, err := c.GetFolder(path.Dir(item.Path))
+	if err != nil {
+		return "", fmt.Errorf("unable to get folder: %w", err)
+	}
+	file, err := c.GetFile(path.Base(item.Path), folderID)
+	if err != nil {
+		return "", err
+	}
+	if file == nil {
+		return "", fmt.Errorf("%s is not in drive", item.Path)
+	}
+	return file.Id, nil
+}
@@ -0,0 +1,362 @@
+package gdrive
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/state"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+const folderType = "application/vnd.google-apps.folder"
+
+var nameQuery = regexp.MustCompile(`name='([^']*)'`)
+
+// fakeDrive is enough of the drive API for listings and resumable uploads
+type fakeDrive struct {
+	lock     sync.Mutex
+	files    []*drive.File
+	requests []*http.Request
+	sessions map[string]*fakeSession
+	accept   int // how many chunks to take before turning the rest down, -1 takes them all
+	data     map[string][]byte
+	t        *testing.T
+}
+
+type fakeSession struct {
+	file *drive.File
+	data []byte
+}
+
+func (f *fakeDrive) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, r)
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/files":
+		query := r.URL.Query().Get("q")
+		parent, _, _ := strings.Cut(strings.TrimPrefix(query, "'"), "'")
+		name := nameQuery.FindStringSubmatch(query)
+		list := &drive.FileList{}
+		for _, file := range f.files {
+			if file.Parents[0] == parent && (name == nil || name[1] == file.Name) {
+				list.Files = append(list.Files, file)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodPost && r.URL.Path == "/files":
+		file := &drive.File{}
+		json.NewDecoder(r.Body).Decode(file)
+		file.Id = "created" + strconv.Itoa(len(f.files))
+		f.files = append(f.files, file)
+		json.NewEncoder(w).Encode(file)
+	case r.Method == http.MethodPost && r.URL.Query().Get("uploadType") == "multipart":
+		// the metadata then the data
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		parts := multipart.NewReader(r.Body, params["boundary"])
+		file := &drive.File{}
+		part, err := parts.NextPart()
+		require.NoError(f.t, err)
+		json.NewDecoder(part).Decode(file)
+		part, err = parts.NextPart()
+		require.NoError(f.t, err)
+		file.Id = "uploaded" + strconv.Itoa(len(f.files))
+		f.files = append(f.files, file)
+		f.data[file.Id], _ = io.ReadAll(part)
+		json.NewEncoder(w).Encode(file)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/files/"):
+		for i, file := range f.files {
+			if file.Id == strings.TrimPrefix(r.URL.Path, "/files/") {
+				f.files = append(f.files[:i], f.files[i+1:]...)
+				break
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && r.URL.Path == "/upload" && r.URL.Query().Get("uploadType") == "resumable":
+		file := &drive.File{}
+		json.NewDecoder(r.Body).Decode(file)
+		id := fmt.Sprintf("session%d", len(f.sessions))
+		f.sessions[id] = &fakeSession{file: file}
+		w.Header().Set("Location", "http://"+r.Host+"/session/"+id)
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/session/"):
+		session := f.sessions[strings.TrimPrefix(r.URL.Path, "/session/")]
+		body, _ := io.ReadAll(r.Body)
+		if len(body) > 0 {
+			if f.accept == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			f.accept--
+		}
+		var start int
+		var total string
+		if len(body) > 0 {
+			fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-", &start)
+			require.Equal(f.t, len(session.data), start, "chunks must carry on from what drive has")
+			session.data = append(session.data, body...)
+		}
+		_, total, _ = strings.Cut(r.Header.Get("Content-Range"), "/")
+		if total != "*" && strconv.Itoa(len(session.data)) == total {
+			session.file.Id = "uploaded" + strconv.Itoa(len(f.files))
+			f.files = append(f.files, session.file)
+			f.data[session.file.Id] = session.data
+			json.NewEncoder(w).Encode(session.file)
+			return
+		}
+		if len(session.data) > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+		}
+		w.WriteHeader(http.StatusPermanentRedirect)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newFakeDrive(t *testing.T, files ...*drive.File) *fakeDrive {
+	return &fakeDrive{t: t, files: files, accept: -1, sessions: make(map[string]*fakeSession), data: make(map[string][]byte)}
+}
+
+func newTestClient(t *testing.T, handler http.Handler) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	srv, err := drive.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	require.NoError(t, err)
+	return &Client{client: srv, baseFolder: "base", Folders: make(map[string]string), FolderIDs: make(map[string]string),
+		http: server.Client(), uploadURL: server.URL + "/upload"}
+}
+
+func TestList(t *testing.T) {
+	modified := "2024-07-14T10:30:00Z"
+	fake := newFakeDrive(t, []*drive.File{
+		{Id: "docs", Name: "docs", MimeType: folderType, Parents: []string{"base"}, ModifiedTime: modified},
+		{Id: "sub", Name: "sub", MimeType: folderType, Parents: []string{"docs"}, ModifiedTime: modified},
+		{Id: "a", Name: "a.txt", Parents: []string{"docs"}, ModifiedTime: modified, Size: 3,
+			AppProperties: map[string]string{hashProperty: "abc"}},
+		{Id: "b", Name: "b.txt", Parents: []string{"sub"}, ModifiedTime: modified},
+		{Id: "top", Name: "top.txt", Parents: []string{"base"}, ModifiedTime: modified},
+		{Id: "versions", Name: versionsFolder, MimeType: folderType, Parents: []string{"base"}, ModifiedTime: modified},
+		{Id: "old", Name: "a.txt@20240101T000000Z", Parents: []string{"versions"}, ModifiedTime: modified},
+	}...)
+	client := newTestClient(t, fake)
+
+	items, err := client.List()
+	require.NoError(t, err)
+	paths := make(map[string]string)
+	for _, item := range items {
+		paths[item.ID] = item.Path
+	}
+	require.Equal(t, map[string]string{
+		"docs": "/docs",
+		"sub":  "/docs/sub",
+		"a":    "/docs/a.txt",
+		"b":    "/docs/sub/b.txt",
+		"top":  "/top.txt",
+	}, paths)
+	for _, item := range items {
+		if item.ID == "a" {
+			require.Equal(t, "abc", item.Hash)
+			require.EqualValues(t, 3, item.Size)
+		}
+	}
+
+	// one listing per folder, none for the versions, and no lookups of single files
+	require.Len(t, fake.requests, 3)
+	for _, r := range fake.requests {
+		require.Equal(t, "1000", r.URL.Query().Get("pageSize"))
+		require.Equal(t, listFields, r.URL.Query().Get("fields"))
+	}
+	require.Equal(t, "/docs/sub", client.FolderIDs["sub"])
+	require.Equal(t, "sub", client.Folders["docs/sub"])
+}
+
+// memSource is a backup.Source with one file in it
+type memSource struct {
+	item backup.Item
+	data []byte
+}
+
+func (m memSource) List(string) ([]backup.Item, error) { return []backup.Item{m.item}, nil }
+func (m memSource) Stat(string) (backup.Item, error)   { return m.item, nil }
+func (m memSource) Open(string) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(m.data)), nil
+}
+
+func TestPutResumable(t *testing.T) {
+	modified := "2024-07-14T10:30:00Z"
+	fake := newFakeDrive(t,
+		&drive.File{Id: "docs", Name: "docs", MimeType: folderType, Parents: []string{"base"}, ModifiedTime: modified},
+		&drive.File{Id: "old", Name: "big.bin", Parents: []string{"docs"}, ModifiedTime: modified},
+	)
+	sessions, err := state.LoadSessions(filepath.Join(t.TempDir(), "uploads.json"))
+	require.NoError(t, err)
+
+	plain := make([]byte, 700*1024)
+	rand.New(rand.NewSource(1)).Read(plain)
+	modTime, _ := time.Parse(time.RFC3339, modified)
+	item := backup.Item{Path: "/docs/big.bin", Name: "big.bin", ModificationTime: modTime, Size: int64(len(plain))}
+	src := memSource{item: item, data: plain}
+	key, err := backup.RawKey([]byte("PPKpKqSMGfX43h2qJbP9cpkn886u9Y2D"))
+	require.NoError(t, err)
+
+	// the connection goes after the first chunk
+	fake.accept = 1
+	client := newTestClient(t, fake)
+	client.ChunkSize = 1 // rounded up to 256KiB
+	client.Sessions = sessions
+	err = client.PutResumable(item, backup.NewUpload(item, src, key))
+	require.Error(t, err)
+	session, ok := sessions.Session("base/docs/big.bin")
+	require.True(t, ok)
+	require.EqualValues(t, 256*1024, session.Offset)
+
+	// the next run carries on, with a new upload that only has the saved session to go on
+	fake.accept = -1
+	client = newTestClient(t, fake)
+	client.ChunkSize, client.Sessions = 1, sessions
+	require.NoError(t, client.PutResumable(item, backup.NewUpload(item, src, key)))
+	_, ok = sessions.Session("base/docs/big.bin")
+	require.False(t, ok, "finished sessions are removed")
+
+	require.Len(t, fake.sessions, 1, "one session for both runs")
+	var uploaded *drive.File
+	for _, file := range fake.files {
+		require.NotEqual(t, "old", file.Id, "the old copy is replaced")
+		if file.Name == "big.bin" {
+			uploaded = file
+		}
+	}
+	require.NotNil(t, uploaded)
+	decrypted, err := key.Decrypt(io.NopCloser(bytes.NewReader(fake.data[uploaded.Id])))
+	require.NoError(t, err)
+	result, err := io.ReadAll(decrypted)
+	require.NoError(t, err)
+	require.Equal(t, plain, result)
+}
+
+func TestPutResumableChanged(t *testing.T) {
+	fake := newFakeDrive(t, &drive.File{Id: "docs", Name: "docs", MimeType: folderType, Parents: []string{"base"}})
+	sessions, err := state.LoadSessions(filepath.Join(t.TempDir(), "uploads.json"))
+	require.NoError(t, err)
+	plain := make([]byte, 700*1024)
+	rand.New(rand.NewSource(1)).Read(plain)
+	item := backup.Item{Path: "/docs/big.bin", Name: "big.bin", ModificationTime: time.Now(), Size: int64(len(plain))}
+	key, err := backup.RawKey([]byte("PPKpKqSMGfX43h2qJbP9cpkn886u9Y2D"))
+	require.NoError(t, err)
+
+	fake.accept = 1
+	client := newTestClient(t, fake)
+	client.ChunkSize, client.Sessions = 1, sessions
+	require.Error(t, client.PutResumable(item, backup.NewUpload(item, memSource{item: item, data: plain}, key)))
+
+	// rewritten in place with the same size and mod time, like cp -p does
+	changed := make([]byte, len(plain))
+	rand.New(rand.NewSource(2)).Read(changed)
+	fake.accept = -1
+	client = newTestClient(t, fake)
+	client.ChunkSize, client.Sessions = 1, sessions
+	upload := backup.NewUpload(item, memSource{item: item, data: changed}, key)
+	require.NoError(t, client.PutResumable(item, upload))
+	require.Len(t, fake.sessions, 2, "the old session is thrown away")
+	sum := sha256.Sum256(changed)
+	require.Equal(t, hex.EncodeToString(sum[:]), upload.Hash(), "hashed on the way up")
+
+	uploaded := fake.files[len(fake.files)-1]
+	decrypted, err := key.Decrypt(io.NopCloser(bytes.NewReader(fake.data[uploaded.Id])))
+	require.NoError(t, err)
+	result, err := io.ReadAll(decrypted)
+	require.NoError(t, err)
+	require.Equal(t, changed, result)
+}
+
+func TestSharedDrive(t *testing.T) {
+	modified := "2024-07-14T10:30:00Z"
+	fake := newFakeDrive(t,
+		&drive.File{Id: "docs", Name: "docs", MimeType: folderType, Parents: []string{"team"}, ModifiedTime: modified},
+		&drive.File{Id: "a", Name: "a.txt", Parents: []string{"docs"}, ModifiedTime: modified},
+	)
+	client := newTestClient(t, fake)
+	client.baseFolder, client.DriveID = "team", "team"
+
+	items, err := client.List()
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.NoError(t, client.EnsureFolder("/photos"))
+	item := backup.Item{Path: "/photos/b.txt", Name: "b.txt", ModificationTime: time.Now(), Size: 5}
+	key, err := backup.RawKey([]byte("PPKpKqSMGfX43h2qJbP9cpkn886u9Y2D"))
+	require.NoError(t, err)
+	require.NoError(t, client.PutResumable(item, backup.NewUpload(item, memSource{item: item, data: []byte("hello")}, key)))
+	uploaded := fake.files[len(fake.files)-1]
+	require.Equal(t, "b.txt", uploaded.Name)
+	require.Equal(t, []string{client.Folders["photos"]}, uploaded.Parents)
+	require.NoError(t, client.Delete(backup.Item{Path: "/docs/a.txt"}))
+
+	for _, r := range fake.requests {
+		if strings.HasPrefix(r.URL.Path, "/session/") {
+			continue // the session URL is all drive needs
+		}
+		query := r.URL.Query()
+		require.Equal(t, "true", query.Get("supportsAllDrives"), "%s %s", r.Method, r.URL)
+		if r.Method == http.MethodGet && r.URL.Path == "/files" {
+			require.Equal(t, "team", query.Get("driveId"))
+			require.Equal(t, "drive", query.Get("corpora"))
+			require.Equal(t, "true", query.Get("includeItemsFromAllDrives"))
+		}
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	fake := newFakeDrive(t,
+		&drive.File{Id: "versions", Name: versionsFolder, MimeType: folderType, Parents: []string{"base"}},
+		&drive.File{Id: "v1", Name: "a.txt@20240101T000000Z", Parents: []string{"versions"}},
+		&drive.File{Id: "v2", Name: "a.txt@20240102T000000Z", Parents: []string{"versions"}},
+		&drive.File{Id: "mine", Name: "a.txt@someone else's", Parents: []string{"versions"}},
+	)
+	client := newTestClient(t, fake)
+
+	deleted, err := client.PruneVersions(config.Retention{KeepLast: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	var left []string
+	for _, file := range fake.files {
+		left = append(left, file.Id)
+	}
+	require.Equal(t, []string{"versions", "v2", "mine"}, left, "names that aren't ours are left alone")
+}
+
+func TestReplaceTakesBackUpload(t *testing.T) {
+	// the fake can't move or trash files, so the old copy has to stay and the new one go
+	fake := newFakeDrive(t,
+		&drive.File{Id: "docs", Name: "docs", MimeType: folderType, Parents: []string{"base"}},
+		&drive.File{Id: "old", Name: "a.txt", Parents: []string{"docs"}},
+		&drive.File{Id: "new", Name: "a.txt", Parents: []string{"docs"}},
+	)
+	client := newTestClient(t, fake)
+	client.KeepVersions = true
+
+	err := client.replace(fake.files[1], "new", "/docs", "docs")
+	require.Error(t, err)
+	file, err := client.GetFile("a.txt", "docs")
+	require.NoError(t, err)
+	require.Equal(t, "old", file.Id, "only one copy is left")
+}
@@ -0,0 +1,47 @@
+package gdrive
+
+import "google.golang.org/api/drive/v3"
+
+// Every call goes through these so the backup can live in a Shared Drive. supportsAllDrives does nothing
+// outside of one, but listings only look in a Shared Drive when they are told which one with DriveID.
+
+func (c *Client) listCall() *drive.FilesListCall {
+	call := c.client.Files.List().SupportsAllDrives(true)
+	if c.DriveID != "" {
+		call = call.Corpora("drive").DriveId(c.DriveID).IncludeItemsFromAllDrives(true)
+	}
+	return call
+}
+
+func (c *Client) getCall(fileID string) *drive.FilesGetCall {
+	return c.client.Files.Get(fileID).SupportsAllDrives(true)
+}
+
+func (c *Client) createCall(file *drive.File) *drive.FilesCreateCall {
+	return c.client.Files.Create(file).SupportsAllDrives(true)
+}
+
+func (c *Client) updateCall(fileID string, file *drive.File) *drive.FilesUpdateCall {
+	return c.client.Files.Update(fileID, file).SupportsAllDrives(true)
+}
+
+func (c *Client) deleteCall(fileID string) *drive.FilesDeleteCall {
+	return c.client.Files.Delete(fileID).SupportsAllDrives(true)
+}
+
+// changes in a Shared Drive are only seen when asking about that drive
+func (c *Client) startTokenCall() *drive.ChangesGetStartPageTokenCall {
+	call := c.client.Changes.GetStartPageToken().SupportsAllDrives(true)
+	if c.DriveID != "" {
+		call = call.DriveId(c.DriveID)
+	}
+	return call
+}
+
+func (c *Client) changesCall(token string) *drive.ChangesListCall {
+	call := c.client.Changes.List(token).SupportsAllDrives(true)
+	if c.DriveID != "" {
+		call = call.DriveId(c.DriveID).IncludeItemsFromAllDrives(true)
+	}
+	return call
+}
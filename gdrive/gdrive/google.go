@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/retry"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
@@ -21,14 +25,27 @@ type Client struct {
 	folderLock sync.Mutex        // so we can cache the folders without conflict
 	Folders    map[string]string // a cached view of folder -> ID
 	FolderIDs  map[string]string // a cached view of folderID -> Folder path
+	// move replaced files into the versions folder rather than deleting them
+	KeepVersions bool
+	// the Shared Drive the base folder is in, empty if it is in My Drive
+	DriveID string
+
+	http      *http.Client // for the resumable uploads the drive library doesn't do
+	retry     *retry.Transport
+	uploadURL string
+	// files bigger than this are uploaded in chunks of this size, and carry on where they
+	// got to if they are cut short and Sessions is set
+	ChunkSize int
+	Sessions  backup.SessionStore
 }
 
 const Scope = drive.DriveFileScope
 
-func NewClient(authFlag, baseFolder string) (*Client, error) {
+// oauthConfig reads the OAuth client from creds.json
+func oauthConfig() (*oauth2.Config, error) {
 	b, err := os.ReadFile("../creds.json")
 	if err != nil {
-		return nil, fmt.Errorf("unable to read client secret file: %v", err)
+		return nil, fmt.Errorf("unable to read client secret file: %w", err)
 	}
 
 	// If modifying these scopes, delete your previously saved token.json.
@@ -36,73 +53,173 @@ func NewClient(authFlag, baseFolder string) (*Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse client secret file, %s", err)
 	}
+	return config, nil
+}
 
-	if authFlag != "" {
-		err := handleToken(authFlag, config)
-		if err != nil {
-			return nil, err
-		}
+func NewClient(baseFolder string) (*Client, error) {
+	config, err := oauthConfig()
+	if err != nil {
+		return nil, err
 	}
 	client, err := getClient(config)
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve Drive client: %v", err)
+		return nil, fmt.Errorf("unable to retrieve Drive client: %w", err)
+	}
+	return newClient(client, baseFolder)
+}
+
+// NewServiceAccountClient signs in with a service account key rather than a user's token, so there
+// is no refresh token to expire. With subject set it acts as that user through domain-wide delegation,
+// which the Workspace admin has to allow for the service account and Scope. Without it the files
+// belong to the service account, which has no storage of its own outside a Shared Drive.
+func NewServiceAccountClient(baseFolder, keyFile, subject string) (*Client, error) {
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account key: %w", err)
 	}
+	client, err := serviceAccountClient(b, subject)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(client, baseFolder)
+}
+
+func serviceAccountClient(key []byte, subject string) (*http.Client, error) {
+	config, err := google.JWTConfigFromJSON(key, Scope)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse service account key, %s", err)
+	}
+	config.Subject = subject
+	return config.Client(context.Background()), nil
+}
+
+// newClient sets up the drive service on top of a signed in http client
+func newClient(client *http.Client, baseFolder string) (*Client, error) {
 	ctx := context.Background()
 
-	srv, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	// the library doesn't retry, so rate limits and server errors are retried under it. The resumable
+	// uploads don't go through this, when a file is retried they carry on from what drive has instead.
+	transport := retry.NewTransport(client.Transport)
+	srv, err := drive.NewService(ctx, option.WithHTTPClient(&http.Client{Transport: transport}))
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve Drive client: %v", err)
+		return nil, fmt.Errorf("unable to retrieve Drive client: %w", err)
 	}
 	folders := make(map[string]string)
 	folderIDs := make(map[string]string)
 	return &Client{client: srv,
 		baseFolder: baseFolder, Folders: folders,
 		FolderIDs:  folderIDs,
-		folderLock: sync.Mutex{}}, nil
+		folderLock: sync.Mutex{},
+		http:       client,
+		retry:      transport,
+		uploadURL:  uploadURL}, nil
 }
 
+// Within stops the waits between retries once ctx is done
+func (c *Client) Within(ctx context.Context) {
+	c.retry.Within(ctx)
+}
+
+const (
+	// only what List needs, fetching every field makes listings much slower
+	listFields  = "nextPageToken, files(id, name, parents, mimeType, modifiedTime, size, appProperties)"
+	listWorkers = 8 // folders listed at once
+)
+
 func (c *Client) ListFiles() ([]*drive.File, error) {
 	return c.listFiles(c.baseFolder)
 }
 
+// listFiles returns everything below baseFolder, with listWorkers workers taking folders off a queue
 func (c *Client) listFiles(baseFolder string) ([]*drive.File, error) {
-	var allFiles []*drive.File
+	var (
+		lock     sync.Mutex
+		wake     = sync.NewCond(&lock)
+		queue    = []string{baseFolder}
+		busy     int // workers listing a folder, that could add more to the queue
+		allFiles []*drive.File
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	worker := func() {
+		defer wg.Done()
+		lock.Lock()
+		defer lock.Unlock()
+		for {
+			for len(queue) == 0 && busy > 0 && firstErr == nil {
+				wake.Wait()
+			}
+			if len(queue) == 0 || firstErr != nil {
+				wake.Broadcast() // so the others see it is finished too
+				return
+			}
+			folderID := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			busy++
+			lock.Unlock()
+			files, err := c.listFolder(folderID)
+			lock.Lock()
+			busy--
+			wake.Broadcast()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			for _, file := range files {
+				if folderID == c.baseFolder && file.Name == versionsFolder {
+					continue // old versions aren't part of the backup
+				}
+				allFiles = append(allFiles, file)
+				// Go through all the folders
+				if file.MimeType == "application/vnd.google-apps.folder" {
+					queue = append(queue, file.Id)
+				}
+			}
+		}
+	}
+	wg.Add(listWorkers)
+	for i := 0; i < listWorkers; i++ {
+		go worker()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return allFiles, nil
+}
+
+// listFolder returns what is directly in the folder
+func (c *Client) listFolder(folderID string) ([]*drive.File, error) {
+	var files []*drive.File
 	pageToken := ""
 	for {
-		query := c.client.Files.List().Q("'" + baseFolder + "' in parents and trashed=false").Fields("files, nextPageToken")
+		query := c.listCall().Q("'" + folderID + "' in parents and trashed=false").Fields(listFields).PageSize(1000)
 		if pageToken != "" {
 			query = query.PageToken(pageToken)
 		}
 		r, err := query.Do()
 		if err != nil {
-			return nil, fmt.Errorf("unable to retrieve files: %v", err)
-		}
-		allFiles = append(allFiles, r.Files...)
-		// Go through all the folders
-		for _, file := range r.Files {
-			if file.MimeType == "application/vnd.google-apps.folder" {
-				folderFiles, err := c.listFiles(file.Id)
-				if err != nil {
-					return nil, err
-				}
-				allFiles = append(allFiles, folderFiles...)
-			}
+			return nil, fmt.Errorf("unable to retrieve files: %w", err)
 		}
+		files = append(files, r.Files...)
 
 		pageToken = r.NextPageToken
 		if pageToken == "" {
-			break
+			return files, nil
 		}
 	}
-	return allFiles, nil
 }
 
 func (c *Client) GetFolder(folderPath string) (string, error) {
+	folderPath = strings.Trim(folderPath, "/")
+	c.folderLock.Lock()
+	defer c.folderLock.Unlock()
 	if id, ok := c.Folders[folderPath]; ok {
 		return id, nil
 	}
-	c.folderLock.Lock()
-	defer c.folderLock.Unlock()
 
 	// Split the path into individual folders
 	folders := strings.Split(folderPath, "/")
@@ -115,7 +232,7 @@ func (c *Client) GetFolder(folderPath string) (string, error) {
 		}
 		folderID, err := c.createFolder(folder, parentID)
 		if err != nil {
-			return "", fmt.Errorf("error creating folder: %v", err)
+			return "", fmt.Errorf("error creating folder: %w", err)
 		}
 		parentID = folderID
 	}
@@ -129,10 +246,10 @@ func (c *Client) createFolder(folderName, parentID string) (string, error) {
 		parentID = c.baseFolder
 	}
 	// Search for the folder
-	r, err := c.client.Files.List().Q(fmt.Sprintf("'%s' in parents and mimeType='application/vnd.google-apps.folder' and name='%s' and trashed=false", parentID, folderName)).
+	r, err := c.listCall().Q(fmt.Sprintf("'%s' in parents and mimeType='application/vnd.google-apps.folder' and name='%s' and trashed=false", parentID, folderName)).
 		Fields("nextPageToken, files(id, name)").Do()
 	if err != nil {
-		return "", fmt.Errorf("error listing files: %v", err)
+		return "", fmt.Errorf("error listing files: %w", err)
 	}
 
 	var folderID string
@@ -149,9 +266,9 @@ func (c *Client) createFolder(folderName, parentID string) (string, error) {
 			MimeType: "application/vnd.google-apps.folder",
 			Parents:  []string{parentID},
 		}
-		folder, err := c.client.Files.Create(folderMetadata).Do()
+		folder, err := c.createCall(folderMetadata).Do()
 		if err != nil {
-			return "", fmt.Errorf("error creating folder: %v", err)
+			return "", fmt.Errorf("error creating folder: %w", err)
 		}
 		folderID = folder.Id
 		log.Printf("Created folder '%s' (ID: %s)\n", folderName, folderID)
@@ -165,8 +282,16 @@ type File struct {
 	Path         string
 	ModifiedTime time.Time
 	Reader       io.ReadCloser
+	Hash         string // kept in appProperties when set
+	ETag         string
 }
 
+// appProperties keys for what we keep alongside each file
+const (
+	hashProperty = "sha256"
+	etagProperty = "sourceEtag"
+)
+
 func (c *Client) UploadFile(file File) error {
 	defer file.Reader.Close()
 
@@ -174,12 +299,12 @@ func (c *Client) UploadFile(file File) error {
 	fp := strings.TrimSuffix(file.Path, file.Name)
 	folderID, err := c.GetFolder(fp)
 	if err != nil {
-		return fmt.Errorf("unable to get folder: %v", err)
+		return fmt.Errorf("unable to get folder: %w", err)
 	}
 	// get existing file
 	existing, err := c.GetFile(file.Name, folderID)
 	if err != nil {
-		return fmt.Errorf("unable to get existing file: %v", err)
+		return fmt.Errorf("unable to get existing file: %w", err)
 	}
 
 	// Create Drive file metadata
@@ -188,43 +313,86 @@ func (c *Client) UploadFile(file File) error {
 		Parents:      []string{folderID},
 		ModifiedTime: file.ModifiedTime.Format(time.RFC3339),
 	}
+	if file.Hash != "" {
+		driveFile.AppProperties = map[string]string{hashProperty: file.Hash, etagProperty: file.ETag}
+	}
 
 	// Upload the file
-	_, err = c.client.Files.Create(driveFile).Media(file.Reader).Do()
+	uploaded, err := c.createCall(driveFile).Media(file.Reader).Do()
 	if err != nil {
-		return fmt.Errorf("error uploading file: %v", err)
+		return fmt.Errorf("error uploading file: %w", err)
 	}
 	log.Printf("Uploaded %s", file.Name)
 	if existing != nil {
-		c.DeleteFile(existing.Id)
+		return c.replace(existing, uploaded.Id, fp, folderID)
 	}
 	return nil
 }
 
+// replace gets rid of a copy that a new upload has replaced, keeping it as a version if we keep them.
+// Two copies with the same name would break every lookup by name after, so if the old one can't be
+// moved it goes to the trash, and if that fails too the new upload is taken back out.
+func (c *Client) replace(existing *drive.File, newID, folderPath, folderID string) error {
+	if c.KeepVersions {
+		err := c.keepVersion(existing, folderPath, folderID)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Could not keep the old version of %s, trashing it instead, %s", existing.Name, err)
+		if c.TrashFile(existing.Id) == nil {
+			return nil
+		}
+		if deleteErr := c.DeleteFile(newID); deleteErr != nil {
+			log.Printf("Could not take back the upload of %s either, %s", existing.Name, deleteErr)
+		}
+		return fmt.Errorf("could not keep the old version of %s, so the upload was taken back: %w", existing.Name, err)
+	}
+	c.DeleteFile(existing.Id)
+	return nil
+}
+
+func (c *Client) DownloadFile(fileID string) (io.ReadCloser, error) {
+	resp, err := c.getCall(fileID).Download()
+	if err != nil {
+		return nil, fmt.Errorf("error downloading file %s: %w", fileID, err)
+	}
+	return resp.Body, nil
+}
+
 func (c *Client) DeleteFile(fileID string) error {
-	err := c.client.Files.Delete(fileID).Do()
+	err := c.deleteCall(fileID).Do()
 	if err != nil {
-		return fmt.Errorf("error deleting file: %v", err)
+		return fmt.Errorf("error deleting file: %w", err)
 	}
 	log.Printf("Deleted %s", fileID)
 	return nil
 }
 
+// TrashFile moves the file to the drive trash, where it can be recovered from for 30 days
+func (c *Client) TrashFile(fileID string) error {
+	_, err := c.updateCall(fileID, &drive.File{Trashed: true}).Do()
+	if err != nil {
+		return fmt.Errorf("error trashing file: %w", err)
+	}
+	log.Printf("Trashed %s", fileID)
+	return nil
+}
+
 func (c *Client) GetFolderByID(folderID string) (*drive.File, error) {
 	// Get the folder details
-	folder, err := c.client.Files.Get(folderID).Fields("id,parents,name").Do()
+	folder, err := c.getCall(folderID).Fields("id,parents,name").Do()
 	if err != nil {
-		return nil, fmt.Errorf("tried to get the folder [%s] but got an error, %s", folderID, err)
+		return nil, fmt.Errorf("tried to get the folder [%s] but got an error, %w", folderID, err)
 	}
 
 	return folder, nil
 }
 
 func (c *Client) GetFile(fileName, parentFolderID string) (*drive.File, error) {
-	r, err := c.client.Files.List().Q(fmt.Sprintf("'%s' in parents and name='%s' and trashed=false", parentFolderID, fileName)).
-		Fields("nextPageToken, files(id, name)").Do()
+	r, err := c.listCall().Q(fmt.Sprintf("'%s' in parents and name='%s' and trashed=false", parentFolderID, fileName)).
+		Fields("nextPageToken, files(id, name, modifiedTime)").Do()
 	if err != nil {
-		return nil, fmt.Errorf("error get file %s: %v", fileName, err)
+		return nil, fmt.Errorf("error get file %s: %w", fileName, err)
 	}
 
 	if len(r.Files) > 1 {
@@ -250,14 +418,14 @@ func (client *Client) GetFullPath(parentID string) (string, error) {
 	parentFolder, err := client.GetFolderByID(parentID)
 	if err != nil {
 
-		return "", fmt.Errorf("error getting parent folder: %v", err)
+		return "", fmt.Errorf("error getting parent folder: %w", err)
 	}
 
 	var parentPath string
 	if parentFolder.Id != client.baseFolder && len(parentFolder.Parents) > 0 {
 		parentPath, err = client.GetFullPath(parentFolder.Parents[0])
 		if err != nil {
-			return "", fmt.Errorf("error getting parent path for %s: %v", parentFolder.Name, err)
+			return "", fmt.Errorf("error getting parent path for %s: %w", parentFolder.Name, err)
 		}
 	} else if parentFolder.Id == client.baseFolder {
 		return parentPath, nil
@@ -10,13 +10,14 @@ import (
 
 func TestGoogleList(t *testing.T) {
 	conf := config.ReadConfig("../../config.json")
-	client, err := NewClient("", conf.GoogleBaseFolder)
+	client, err := NewClient(conf.GoogleBaseFolder)
 	require.NoError(t, err)
 	files, err := client.ListFiles()
 	require.NoError(t, err)
 
 	for _, f := range files {
-		fullPath := client.GetFullPath(f.Parents[0])
+		fullPath, err := client.GetFullPath(f.Parents[0])
+		require.NoError(t, err)
 		log.Printf("file: %s,  path %s ", f.Name, fullPath)
 	}
 	t.Fail()
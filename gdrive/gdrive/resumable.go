@@ -0,0 +1,264 @@
+package gdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	uploadURL        = "https://www.googleapis.com/upload/drive/v3/files"
+	defaultChunkSize = 16 * 1024 * 1024
+	chunkMultiple    = 256 * 1024 // drive wants every chunk but the last to be a multiple of this
+)
+
+// PutResumable uploads big files in chunks through a resumable upload session. The session is kept
+// in Sessions, so if the upload is cut short the next run carries on from what drive already has.
+func (c *Client) PutResumable(item backup.Item, upload *backup.Upload) error {
+	chunkSize := c.chunkSize()
+	if item.Size <= int64(chunkSize) {
+		// not worth a session
+		err := upload.Start()
+		if err != nil {
+			return err
+		}
+		reader, err := upload.Open(0)
+		if err != nil {
+			return err
+		}
+		return c.UploadFile(File{Name: item.Name, Path: item.Path, ModifiedTime: item.ModificationTime, Reader: reader, Hash: item.Hash, ETag: item.ETag})
+	}
+
+	fp := strings.TrimSuffix(item.Path, item.Name)
+	folderID, err := c.GetFolder(fp)
+	if err != nil {
+		return fmt.Errorf("unable to get folder: %w", err)
+	}
+
+	key := c.baseFolder + item.Path
+	session, offset, file := c.resume(key, item, upload)
+	if file == nil {
+		if session.URI == "" {
+			err = upload.Start()
+			if err != nil {
+				return err
+			}
+			session, err = c.startSession(item, folderID)
+			if err != nil {
+				return err
+			}
+			session, err = upload.Session(session)
+			if err != nil {
+				return err
+			}
+			session.Header = upload.Header
+			c.saveSession(key, session)
+		}
+		reader, err := upload.Open(offset)
+		if err != nil {
+			c.deleteSession(key) // it can't carry on, so the next run shouldn't try to either
+			return err
+		}
+		file, err = c.sendChunks(key, session, upload, reader, offset, chunkSize)
+		if err != nil {
+			return fmt.Errorf("error uploading %s, it will carry on from where it got to next time: %w", item.Path, err)
+		}
+	}
+	c.deleteSession(key)
+
+	// anything else with the name is what this replaces
+	r, err := c.listCall().Q(fmt.Sprintf("'%s' in parents and name='%s' and trashed=false", folderID, item.Name)).
+		Fields("nextPageToken, files(id, name, modifiedTime)").Do()
+	if err != nil {
+		return fmt.Errorf("uploaded %s but could not look for the old copy: %w", item.Name, err)
+	}
+	for _, existing := range r.Files {
+		if existing.Id == file.Id {
+			continue
+		}
+		err = c.replace(existing, file.Id, fp, folderID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resume picks up the session from an earlier run if there is one that can carry on, returning
+// it with how much drive has. If that run got to the end, the file it made is returned.
+func (c *Client) resume(key string, item backup.Item, upload *backup.Upload) (backup.UploadSession, int64, *drive.File) {
+	if c.Sessions == nil {
+		return backup.UploadSession{}, 0, nil
+	}
+	session, ok := c.Sessions.Session(key)
+	if !ok {
+		return backup.UploadSession{}, 0, nil
+	}
+	if !upload.Matches(session) {
+		log.Printf("%s has changed since its upload was cut short, starting again", item.Path)
+		c.deleteSession(key)
+		return backup.UploadSession{}, 0, nil
+	}
+	offset, file, err := c.putChunk(session.URI, nil, 0, "*")
+	if err != nil {
+		log.Printf("Could not carry on uploading %s, starting again, %s", item.Path, err)
+		c.deleteSession(key)
+		return backup.UploadSession{}, 0, nil
+	}
+	upload.Header = session.Header
+	if file == nil {
+		log.Printf("Carrying on uploading %s from %d bytes", item.Path, offset)
+	}
+	return session, offset, file
+}
+
+// startSession asks drive for somewhere to upload the file to
+func (c *Client) startSession(item backup.Item, folderID string) (backup.UploadSession, error) {
+	metadata := &drive.File{
+		Name:         item.Name,
+		Parents:      []string{folderID},
+		ModifiedTime: item.ModificationTime.Format(time.RFC3339),
+	}
+	if item.Hash != "" {
+		metadata.AppProperties = map[string]string{hashProperty: item.Hash, etagProperty: item.ETag}
+	}
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return backup.UploadSession{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.uploadURL+"?uploadType=resumable&supportsAllDrives=true&fields=id", bytes.NewReader(body))
+	if err != nil {
+		return backup.UploadSession{}, err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/octet-stream")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return backup.UploadSession{}, fmt.Errorf("error starting upload of %s: %w", item.Path, err)
+	}
+	defer resp.Body.Close()
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return backup.UploadSession{}, fmt.Errorf("error starting upload of %s: %w", item.Path, err)
+	}
+	if resp.Header.Get("Location") == "" {
+		return backup.UploadSession{}, fmt.Errorf("error starting upload of %s: drive said %s without a session", item.Path, resp.Status)
+	}
+	return backup.UploadSession{URI: resp.Header.Get("Location")}, nil
+}
+
+// sendChunks uploads reader, which starts at offset, a chunk at a time keeping the session up to date as it goes
+func (c *Client) sendChunks(key string, session backup.UploadSession, upload *backup.Upload, reader io.ReadCloser, offset int64, chunkSize int) (*drive.File, error) {
+	defer func() { reader.Close() }()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(reader, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return nil, err
+		}
+		total := "*" // encrypted files don't have a size until they are done
+		if last {
+			total = strconv.FormatInt(offset+int64(n), 10)
+		}
+		committed, file, err := c.putChunk(session.URI, buf[:n], offset, total)
+		if err != nil {
+			return nil, err
+		}
+		if file != nil {
+			return file, nil
+		}
+		if committed != offset+int64(n) {
+			// drive kept less than it was sent, go back to where it got to
+			reader.Close()
+			reader, err = upload.Open(committed)
+			if err != nil {
+				return nil, err
+			}
+		} else if last {
+			return nil, fmt.Errorf("drive has all %d bytes but didn't finish the upload", committed)
+		}
+		offset = committed
+		session.Offset = offset
+		c.saveSession(key, session)
+	}
+}
+
+// putChunk sends data, which starts at offset, to the session. total is the size of the whole
+// upload or * if that isn't known yet, and no data asks how far the upload has got.
+// It returns how much drive has, and the file once the upload is complete.
+func (c *Client) putChunk(uri string, data []byte, offset int64, total string) (int64, *drive.File, error) {
+	req, err := http.NewRequest(http.MethodPut, uri, bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) == 0 {
+		req.Header.Set("Content-Range", "bytes */"+total)
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(data))-1, total))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		var file drive.File
+		err = json.NewDecoder(resp.Body).Decode(&file)
+		if err != nil {
+			return 0, nil, fmt.Errorf("could not read the uploaded file: %w", err)
+		}
+		return offset + int64(len(data)), &file, nil
+	case http.StatusPermanentRedirect: // drive uses 308 for resume incomplete
+		// Range is the bytes drive has, like bytes=0-1234, there isn't one if it has none
+		_, end, ok := strings.Cut(resp.Header.Get("Range"), "-")
+		if !ok {
+			return 0, nil, nil
+		}
+		last, err := strconv.ParseInt(end, 10, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("drive sent a bad range %s", resp.Header.Get("Range"))
+		}
+		return last + 1, nil, nil
+	}
+	return 0, nil, googleapi.CheckResponse(resp)
+}
+
+func (c *Client) chunkSize() int {
+	if c.ChunkSize <= 0 {
+		return defaultChunkSize
+	}
+	return (c.ChunkSize + chunkMultiple - 1) / chunkMultiple * chunkMultiple
+}
+
+func (c *Client) saveSession(key string, session backup.UploadSession) {
+	if c.Sessions == nil {
+		return
+	}
+	err := c.Sessions.SaveSession(key, session)
+	if err != nil {
+		log.Printf("Could not save the upload session, it will start again if it is cut short, %s", err)
+	}
+}
+
+func (c *Client) deleteSession(key string) {
+	if c.Sessions == nil {
+		return
+	}
+	err := c.Sessions.DeleteSession(key)
+	if err != nil {
+		log.Printf("Could not remove the finished upload session, %s", err)
+	}
+}
@@ -2,33 +2,215 @@ package gdrive
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sync"
 
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 )
 
 const tokenFile = "../token.json"
 
-func handleToken(token string, config *oauth2.Config) error {
-	exchangeToken, err := config.Exchange(context.TODO(), token)
+const callbackPath = "/oauth2callback"
+
+// google sends verification_url rather than the verification_uri the library reads, it is always this
+const deviceVerificationURL = "https://www.google.com/device"
+
+// Login signs in and saves the token for the next runs. With device set it is done by entering a
+// code on any other device, for boxes with no browser, otherwise through the browser on this one.
+func Login(ctx context.Context, device bool) error {
+	config, err := oauthConfig()
+	if err != nil {
+		return err
+	}
+	var token *oauth2.Token
+	if device {
+		token, err = AuthorizeDevice(ctx, config, func(userCode, verificationURL string) {
+			fmt.Printf("Go to %s on any device and enter the code %s\n", verificationURL, userCode)
+		})
+	} else {
+		token, err = Authorize(ctx, config, func(authURL string) {
+			fmt.Printf("Go to the following link in your browser to sign in:\n%s\n", authURL)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return saveToken(tokenFile, token)
+}
+
+// AuthorizeDevice gets a token with the device flow. show is given a code for the user to enter at
+// the verification URL, then the token endpoint is polled until they have, or the code runs out.
+// The OAuth client has to be a "TVs and Limited Input devices" one for google to allow this.
+func AuthorizeDevice(ctx context.Context, config *oauth2.Config, show func(userCode, verificationURL string)) (*oauth2.Token, error) {
+	device := *config
+	if device.Endpoint.DeviceAuthURL == "" {
+		// creds.json doesn't have it
+		device.Endpoint.DeviceAuthURL = google.Endpoint.DeviceAuthURL
+	}
+	response, err := device.DeviceAuth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start the device sign in: %w", err)
+	}
+	verificationURL := response.VerificationURI
+	if verificationURL == "" {
+		verificationURL = deviceVerificationURL
+	}
+	show(response.UserCode, verificationURL)
+
+	token, err := device.DeviceAccessToken(ctx, response)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve token from the device sign in: %w", err)
+	}
+	return token, nil
+}
+
+// Authorize gets a token with the authorization code flow. show is given the link to sign in with,
+// which redirects back to a server on a random loopback port. The code is tied to this run with
+// PKCE and a random state, so a code from anywhere else is turned away.
+func Authorize(ctx context.Context, config *oauth2.Config, show func(authURL string)) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to start the redirect server: %w", err)
+	}
+	defer listener.Close()
+
+	// a copy, so the redirect doesn't stick to the caller's config
+	loopback := *config
+	loopback.RedirectURL = "http://" + listener.Addr().String() + callbackPath
+	state, err := randomState()
+	if err != nil {
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	codes := make(chan string, 1)
+	errs := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 {
+			// not from the link we gave out, ignore it and keep waiting
+			http.Error(w, "State does not match, start again from the link", http.StatusBadRequest)
+			return
+		}
+		if query.Get("error") != "" {
+			http.Error(w, "Sign in failed: "+query.Get("error"), http.StatusBadRequest)
+			select {
+			case errs <- fmt.Errorf("sign in failed: %s", query.Get("error")):
+			default:
+			}
+			return
+		}
+		if query.Get("code") == "" {
+			http.Error(w, "No authorization code", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "Signed in, you can close this window.")
+		select {
+		case codes <- query.Get("code"):
+		default:
+		}
+	})
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+
+	show(loopback.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier)))
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-errs:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	token, err := loopback.Exchange(ctx, code, oauth2.VerifierOption(verifier))
 	if err != nil {
-		return fmt.Errorf("unable to retrieve token from web %v", err)
+		return nil, fmt.Errorf("unable to retrieve token from web %v", err)
+	}
+	return token, nil
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
 	}
-	return saveToken(tokenFile, exchangeToken)
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
+// saveToken writes the token to a temp file then renames it over the old one, so a run
+// stopped part way through a refresh doesn't leave half a token file behind
 func saveToken(path string, token *oauth2.Token) error {
 	log.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	b, err := json.Marshal(token)
 	if err != nil {
 		return fmt.Errorf("unable to cache oauth token: %s", err)
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(token)
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to cache oauth token: %s", err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("unable to cache oauth token: %s", err)
+	}
+	return nil
+}
+
+// ErrReauthorize is when google won't refresh the token any more, because access was
+// revoked or the refresh token expired. Nothing will work until auth is run again.
+var ErrReauthorize = errors.New("re-authorization required, run auth again")
+
+// savingTokenSource writes tokens back to the token file when they are refreshed, so the
+// next run starts with the newest one rather than the one from when we signed in
+type savingTokenSource struct {
+	base    oauth2.TokenSource
+	path    string
+	lock    sync.Mutex
+	last    string // the access token in the file
+	revoked bool   // so it is only logged once, every request tries again
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	token, err := s.base.Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			if !s.revoked {
+				log.Printf("Google won't refresh the token (%s), sign in again with the auth command", retrieveErr.ErrorDescription)
+				s.revoked = true
+			}
+			return nil, ErrReauthorize
+		}
+		return nil, err
+	}
+	if token.AccessToken != s.last {
+		// the next request tries again if this fails
+		err = saveToken(s.path, token)
+		if err != nil {
+			log.Printf("Could not save the refreshed token, %s", err)
+		} else {
+			s.last = token.AccessToken
+		}
+	}
+	return token, nil
 }
 
 // Retrieve a token, saves the token, then returns the generated client.
@@ -40,7 +222,9 @@ func getClient(config *oauth2.Config) (*http.Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("can't read token file, %s", err)
 	}
-	return config.Client(context.Background(), tok), nil
+	ctx := context.Background()
+	source := &savingTokenSource{base: config.TokenSource(ctx, tok), path: tokenFile, last: tok.AccessToken}
+	return oauth2.NewClient(ctx, source), nil
 }
 
 // Retrieves a token from a local file.
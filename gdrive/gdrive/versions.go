@@ -0,0 +1,89 @@
+package gdrive
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+	"google.golang.org/api/drive/v3"
+)
+
+const (
+	// replaced files are moved in here instead of being deleted, under the same folders they were in
+	versionsFolder    = ".versions"
+	versionTimeFormat = "20060102T150405Z"
+)
+
+// keepVersion moves a file that is about to be replaced into the versions folder,
+// with the time it was last modified added to the name
+func (c *Client) keepVersion(existing *drive.File, folderPath, parentID string) error {
+	versionsID, err := c.GetFolder(versionsFolder + "/" + strings.Trim(folderPath, "/"))
+	if err != nil {
+		return fmt.Errorf("unable to get versions folder: %w", err)
+	}
+	modTime, err := time.Parse(time.RFC3339, existing.ModifiedTime)
+	if err != nil {
+		modTime = time.Now()
+	}
+	name := existing.Name + "@" + modTime.UTC().Format(versionTimeFormat)
+	_, err = c.updateCall(existing.Id, &drive.File{Name: name}).
+		AddParents(versionsID).RemoveParents(parentID).Do()
+	if err != nil {
+		return fmt.Errorf("error moving %s to the versions folder: %w", existing.Name, err)
+	}
+	log.Printf("Kept the old version of %s as %s", existing.Name, name)
+	return nil
+}
+
+// PruneVersions deletes the old versions that the policy doesn't keep, returning how many went
+func (c *Client) PruneVersions(policy config.Retention) (int, error) {
+	versionsID, err := c.GetFolder(versionsFolder)
+	if err != nil {
+		return 0, fmt.Errorf("unable to get versions folder: %w", err)
+	}
+	files, err := c.listFiles(versionsID)
+	if err != nil {
+		return 0, err
+	}
+
+	// versions of the same file share a folder and the name before the @
+	versions := make(map[string][]*drive.File)
+	for _, file := range files {
+		at := strings.LastIndex(file.Name, "@")
+		if file.MimeType == "application/vnd.google-apps.folder" || at < 0 || len(file.Parents) == 0 {
+			continue
+		}
+		original := file.Parents[0] + "/" + file.Name[:at]
+		versions[original] = append(versions[original], file)
+	}
+
+	now := time.Now()
+	deleted := 0
+	for _, all := range versions {
+		// names we can't read the time from aren't ours, so they are left out of the pruning altogether
+		var files []*drive.File
+		var times []time.Time
+		for _, file := range all {
+			t, err := time.Parse(versionTimeFormat, file.Name[strings.LastIndex(file.Name, "@")+1:])
+			if err != nil {
+				continue
+			}
+			files = append(files, file)
+			times = append(times, t)
+		}
+		for i, keep := range backup.KeepVersions(policy, times, now) {
+			if keep {
+				continue
+			}
+			err := c.DeleteFile(files[i].Id)
+			if err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,97 @@
+package local
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+)
+
+// Destination keeps backups in a folder, such as one on an external disk
+type Destination struct {
+	root string
+}
+
+// NewDestination backs up into root, which has to exist already so an unmounted disk isn't mistaken for an empty one
+func NewDestination(root string) (*Destination, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("could not use %s for backups, %s", root, err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("could not use %s for backups, it is not a directory", root)
+	}
+	return &Destination{root: root}, nil
+}
+
+func (d *Destination) List() ([]backup.Item, error) {
+	var items []backup.Item
+	err := filepath.WalkDir(d.root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == d.root || isPartial(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.root, filePath)
+		if err != nil {
+			return err
+		}
+		item := toItem("/"+filepath.ToSlash(rel), info)
+		item.ID = item.Path
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list backups in %s, %s", d.root, err)
+	}
+	return items, nil
+}
+
+// isPartial says if name is one of writeFile's temporary files, rather than a file of ours that ends in .partial
+func isPartial(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".partial")
+}
+
+func (d *Destination) EnsureFolder(folderPath string) error {
+	err := os.MkdirAll(d.fullPath(folderPath), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create folder %s, %s", folderPath, err)
+	}
+	return nil
+}
+
+// Put writes the new copy beside the old one and then renames it over the top
+func (d *Destination) Put(item backup.Item, reader io.Reader) error {
+	return writeFile(d.fullPath(item.Path), reader, item.ModificationTime)
+}
+
+func (d *Destination) Delete(item backup.Item) error {
+	err := os.Remove(d.fullPath(item.Path))
+	if err != nil {
+		return fmt.Errorf("could not delete %s, %s", item.Path, err)
+	}
+	return nil
+}
+
+func (d *Destination) Get(item backup.Item) (io.ReadCloser, error) {
+	f, err := os.Open(d.fullPath(item.Path))
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s, %s", item.Path, err)
+	}
+	return f, nil
+}
+
+// fullPath puts a backup path under the root, cleaning it first so it can't climb out
+func (d *Destination) fullPath(itemPath string) string {
+	return filepath.Join(d.root, filepath.FromSlash(path.Clean("/"+itemPath)))
+}
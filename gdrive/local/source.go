@@ -0,0 +1,126 @@
+package local
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+)
+
+// Source reads files straight off a local disk or mount
+type Source struct{}
+
+func NewSource() *Source {
+	return &Source{}
+}
+
+// List walks everything below dir. Paths use forward slashes so they line up with the other backends.
+func (s *Source) List(dir string) ([]backup.Item, error) {
+	log.Printf("Looking at %s", dir)
+	var items []backup.Item
+	err := filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == dir {
+			return nil
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			log.Printf("Skipping %s, it is not a regular file", filePath)
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		items = append(items, toItem(filePath, info))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read directory, %s", err)
+	}
+	return items, nil
+}
+
+func (s *Source) Stat(filePath string) (backup.Item, error) {
+	info, err := os.Stat(filepath.FromSlash(filePath))
+	if err != nil {
+		return backup.Item{}, fmt.Errorf("could not stat %s, %s", filePath, err)
+	}
+	return toItem(filePath, info), nil
+}
+
+func (s *Source) Open(filePath string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.FromSlash(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("could not open file, %s", err)
+	}
+	return f, nil
+}
+
+// OpenAt opens the file part way in, for carrying on with an upload
+func (s *Source) OpenAt(filePath string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.FromSlash(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("could not open file, %s", err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not open file at %d, %s", offset, err)
+	}
+	return f, nil
+}
+
+// UploadFile writes a restored file back to disk, with the same name as the nextcloud client's method so either can be restored to
+func (s *Source) UploadFile(filePath string, reader io.Reader, modTime time.Time) error {
+	return writeFile(filepath.FromSlash(filePath), reader, modTime)
+}
+
+func toItem(filePath string, info fs.FileInfo) backup.Item {
+	return backup.Item{
+		Name:             info.Name(),
+		Path:             filepath.ToSlash(filePath),
+		ModificationTime: info.ModTime(),
+		Dir:              info.IsDir(),
+		Size:             info.Size(),
+	}
+}
+
+// writeFile writes to a temporary file next to the target and renames it over the top,
+// so a failed write never leaves half a file behind
+func writeFile(filePath string, reader io.Reader, modTime time.Time) error {
+	err := os.MkdirAll(filepath.Dir(filePath), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create folder for %s, %s", filePath, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".*.partial")
+	if err != nil {
+		return fmt.Errorf("could not create %s, %s", filePath, err)
+	}
+	defer os.Remove(tmp.Name()) // does nothing once the rename has happened
+
+	_, err = io.Copy(tmp, reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %s, %s", filePath, err)
+	}
+	if !modTime.IsZero() {
+		err = os.Chtimes(tmp.Name(), modTime, modTime)
+		if err != nil {
+			return fmt.Errorf("could not set the modification time of %s, %s", filePath, err)
+		}
+	}
+	err = os.Rename(tmp.Name(), filePath)
+	if err != nil {
+		return fmt.Errorf("could not write %s, %s", filePath, err)
+	}
+	return nil
+}
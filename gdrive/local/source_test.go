@@ -0,0 +1,103 @@
+package local
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSourceList(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Date(2024, 7, 14, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "photos", "2024"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("hello"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "photos", "2024", "cat.jpg"), []byte("meow meow"), 0644))
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "notes.txt"), modTime, modTime))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "notes.txt"), filepath.Join(dir, "link.txt")))
+
+	items, err := NewSource().List(dir)
+	require.NoError(t, err)
+	sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+
+	var paths []string
+	for _, item := range items {
+		paths = append(paths, strings.TrimPrefix(item.Path, filepath.ToSlash(dir)))
+	}
+	require.Equal(t, []string{"/notes.txt", "/photos", "/photos/2024", "/photos/2024/cat.jpg"}, paths)
+	require.True(t, items[0].ModificationTime.Equal(modTime))
+	require.EqualValues(t, 5, items[0].Size)
+	require.True(t, items[1].Dir)
+	require.Equal(t, "cat.jpg", items[3].Name)
+	require.EqualValues(t, 9, items[3].Size)
+}
+
+func TestSourceUploadFile(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Date(2024, 7, 14, 10, 30, 0, 0, time.UTC)
+	target := filepath.ToSlash(filepath.Join(dir, "restored", "notes.txt"))
+
+	err := NewSource().UploadFile(target, strings.NewReader("hello again"), modTime)
+	require.NoError(t, err)
+
+	item, err := NewSource().Stat(target)
+	require.NoError(t, err)
+	require.True(t, item.ModificationTime.Equal(modTime))
+	b, err := os.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "hello again", string(b))
+	leftovers, err := filepath.Glob(filepath.Join(dir, "restored", "*.partial"))
+	require.NoError(t, err)
+	require.Empty(t, leftovers)
+}
+
+func TestDestination(t *testing.T) {
+	root := t.TempDir()
+	modTime := time.Date(2024, 7, 14, 10, 30, 0, 0, time.UTC)
+	dst, err := NewDestination(root)
+	require.NoError(t, err)
+
+	item := backup.Item{Path: "/docs/notes.txt", Name: "notes.txt", ModificationTime: modTime}
+	require.NoError(t, dst.EnsureFolder("/docs"))
+	require.NoError(t, dst.Put(item, strings.NewReader("first")))
+	require.NoError(t, dst.Put(item, strings.NewReader("second")))
+
+	items, err := dst.List()
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+	require.Equal(t, "/docs", items[0].Path)
+	require.True(t, items[0].Dir)
+	require.Equal(t, "/docs/notes.txt", items[1].Path)
+	require.True(t, items[1].ModificationTime.Equal(modTime))
+
+	f, err := dst.Get(items[1])
+	require.NoError(t, err)
+	b, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	require.Equal(t, "second", string(b))
+
+	require.NoError(t, dst.Delete(items[1]))
+	_, err = os.Stat(filepath.Join(root, "docs", "notes.txt"))
+	require.True(t, os.IsNotExist(err))
+
+	// a file that happens to end in .partial is backed up like any other, a leftover upload isn't
+	partial := backup.Item{Path: "/docs/x.partial", Name: "x.partial", ModificationTime: modTime}
+	require.NoError(t, dst.Put(partial, strings.NewReader("real")))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "docs", ".notes.txt.123.partial"), []byte("cut short"), 0644))
+	items, err = dst.List()
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+	require.Equal(t, "/docs/x.partial", items[1].Path)
+
+	_, err = NewDestination(filepath.Join(root, "not-mounted"))
+	require.Error(t, err)
+}
@@ -1,135 +1,721 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"iter"
 	"log"
-	"sync"
+	"os"
+	"time"
 
 	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
 	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
 	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/gdrive"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/local"
 	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/nextcloud"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/report"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/retry"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/s3"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/state"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/throttle"
 )
 
 var (
-	tokenFlag string
 	dryRun    bool
+	reconcile bool
+
+	// what this backup run has done, nil for the other commands
+	rep        *report.Report
+	reportFile string
 )
 
+const configPath = "../config.json"
+
 func main() {
-	flag.StringVar(&tokenFlag, "auth", "", "Auth token")
 	flag.BoolVar(&dryRun, "dry-run", false, "Dry run")
+	flag.BoolVar(&reconcile, "reconcile", false, "List the destinations in full instead of trusting the state file")
 	flag.Parse()
+	if flag.Arg(0) == "auth" {
+		// before anything connects, there is no token to connect with yet
+		flags := flag.NewFlagSet("auth", flag.ExitOnError)
+		device := flags.Bool("device", false, "Sign in by entering a code on another device, for when there is no browser here")
+		flags.Parse(flag.Args()[1:])
+		err := gdrive.Login(context.Background(), *device)
+		if err != nil {
+			log.Fatalf("Could not sign in, %s", err)
+		}
+		log.Printf("Signed in")
+		return
+	}
+	if flag.Arg(0) == "" || flag.Arg(0) == "backup" {
+		rep = report.New(time.Now())
+	}
 
 	// Read config json
-	conf := config.ReadConfig("../config.json")
-	// Setup gdrive..
-	log.Printf("Connecting to google")
-	g, err := gdrive.NewClient(tokenFlag, conf.GoogleBaseFolder)
+	conf := config.ReadConfig(configPath)
+	reportFile = conf.ReportFile
+	s, err := newSetup(conf)
 	if err != nil {
-		log.Fatalf("Could not setup google drive because %s", err)
+		fatalf("Could not start, %s", err)
+	}
+
+	switch flag.Arg(0) {
+	case "", "backup":
+		var lock *state.Lock
+		if conf.LockFile != "" {
+			lock, err = state.TryLock(conf.LockFile)
+			if err != nil {
+				fatalf("Could not start, %s", err)
+			}
+		}
+		s.backup(conf.Directories)
+		finishReport()
+		// held until here, nothing using it would let the GC close the file and drop the lock mid run
+		lock.Unlock()
+		os.Exit(rep.ExitCode())
+	case "daemon":
+		runDaemon(s)
+	case "restore":
+		// restores aren't held to the upload windows, just the speeds
+		runRestore(flag.Args()[1:], s.destinations, s.sources, conf.Directories, s.keys, throttle.New(context.Background(), conf.Limits, nil))
+	case "prune":
+		if conf.Retention == nil {
+			log.Fatalf("Nothing to prune, there is no retention in the config")
+		}
+		prune(s.destinations, *conf.Retention)
+	default:
+		log.Fatalf("Unknown command %s, expected backup, daemon, restore, prune or auth", flag.Arg(0))
 	}
+}
 
-	// Setup nextcloud
-	log.Printf("Connecting to nextcloud")
-	nc, err := nextcloud.NewClient()
+// setup is everything a run needs, connected up from the config
+type setup struct {
+	conf         config.Config
+	keys         map[string]*backup.Key
+	destinations []namedDestination
+	sources      map[string]backup.Source
+	schedule     throttle.Schedule
+	st           *state.State
+}
+
+func newSetup(conf config.Config) (*setup, error) {
+	// Get the keys first, so a bad one stops us before any work is done
+	keys, err := loadKeys(conf.Directories)
 	if err != nil {
-		log.Fatalf("Could not setup nextcloud because %s", err)
+		return nil, fmt.Errorf("could not load encryption keys, %s", err)
+	}
+
+	var sessions backup.SessionStore
+	if conf.ResumeFile != "" {
+		sessions, err = state.LoadSessions(conf.ResumeFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load upload sessions, %s", err)
+		}
 	}
 
-	// Generate the list of files from google, with their modification times
-	log.Printf("Searching google")
-	googleFiles, err := backup.GenerateFileListFromGoogle(g)
+	destinations, err := connectDestinations(conf.DestinationList(), conf.GoogleBaseFolder, conf.Retention != nil, sessions)
 	if err != nil {
-		log.Fatalf("Could not generate google drive list, %s", err)
+		return nil, fmt.Errorf("could not setup destinations because %s", err)
 	}
 
-	// Generate the list of files from nextcloud, with their modification times
-	log.Printf("Searching nextcloud")
-	nextcloudFiles, err := backup.GenerateFileListFromNextcloud(nc, conf.Directories)
+	sources, err := connectSources(conf.Directories)
 	if err != nil {
-		log.Fatalf("Could not generate nextcloud list, %s", err)
-	}
-	log.Printf("*** comparing changes ***")
-	// Compare the list of files to work out what needs to be uploaded
-	// Generate a list of files, use works to upload the files
-	for key, value := range nextcloudFiles {
-		log.Printf("Checking for changes in %s", key)
-		changes := backup.FindChanges(value, googleFiles)
+		return nil, fmt.Errorf("could not setup sources because %s", err)
+	}
+
+	schedule, err := throttle.ParseSchedule(conf.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the schedule, %s", err)
+	}
+
+	var st *state.State
+	if conf.StateFile != "" {
+		st, err = state.Load(conf.StateFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load state, %s", err)
+		}
+	}
+	return &setup{conf: conf, keys: keys, destinations: destinations, sources: sources, schedule: schedule, st: st}, nil
+}
+
+// backup copies dirs to every destination, as far as the upload window allows, and prunes old versions
+func (s *setup) backup(dirs []config.DirectoryConfig) {
+	if _, open := s.schedule.At(time.Now()); !open {
+		log.Printf("Outside the upload windows, nothing to do until the next one")
+		rep.Stop("outside the upload windows")
+		return
+	}
+	reconcileAfter := time.Duration(s.conf.ReconcileDays) * 24 * time.Hour
+	if reconcileAfter == 0 {
+		reconcileAfter = defaultReconcileAfter
+	}
+	ctx, cancel := windowContext(s.schedule)
+	defer cancel()
+	runBackup(ctx, s.sources, s.destinations, dirs, s.keys, throttle.New(ctx, s.conf.Limits, s.schedule), s.st, reconcileAfter)
+	if s.conf.Retention != nil {
+		prune(s.destinations, *s.conf.Retention)
+	}
+}
+
+// fatalf stops the run, writing the report first if there is one
+func fatalf(format string, args ...any) {
+	if rep != nil {
+		rep.SetFatal(fmt.Errorf(format, args...))
+		finishReport()
+	}
+	log.Fatalf(format, args...)
+}
+
+// fail records a failure in the report, picking out a destination that needs signing in again
+func fail(destination, path string, err error) {
+	rep.Fail(destination, path, err)
+	if errors.Is(err, gdrive.ErrReauthorize) {
+		rep.Reauthorize(destination)
+	}
+}
+
+// finishReport logs how the run went, and writes the report if the config says where
+func finishReport() {
+	rep.Finish(time.Now())
+	log.Printf("Finished, %s", rep.Summary())
+	if reportFile == "" {
+		return
+	}
+	err := rep.Write(reportFile)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+}
+
+// prune removes the old versions the retention policy no longer keeps
+func prune(destinations []namedDestination, policy config.Retention) {
+	for _, dst := range destinations {
+		pruner, ok := dst.Destination.(backup.Pruner)
+		if !ok {
+			log.Printf("%s doesn't keep old versions, nothing to prune", dst.name)
+			continue
+		}
+		if dryRun {
+			log.Printf("Would prune old versions from %s", dst.name)
+			continue
+		}
+		deleted, err := pruner.PruneVersions(policy)
+		if err != nil {
+			log.Printf("Could not prune %s, %s", dst.name, err)
+			if rep != nil {
+				fail(dst.name, "", fmt.Errorf("could not prune, %w", err))
+			}
+			continue
+		}
+		log.Printf("Pruned %d old versions from %s", deleted, dst.name)
+	}
+}
+
+// defaultReconcileAfter is how long the state is trusted before a destination is listed in full again
+const defaultReconcileAfter = 7 * 24 * time.Hour
+
+// windowContext is done when the schedule says the run has to stop
+func windowContext(schedule throttle.Schedule) (context.Context, context.CancelFunc) {
+	closes, ok := schedule.Closes(time.Now())
+	if !ok {
+		return context.WithCancel(context.Background())
+	}
+	log.Printf("The upload window closes at %s", closes.Format("15:04"))
+	return context.WithDeadlineCause(context.Background(), closes, throttle.ErrWindowClosed)
+}
+
+// target is a destination that could be listed, with what it has backed up
+type target struct {
+	dst      namedDestination
+	index    *state.Index
+	backedUp []backup.Item
+}
+
+func runBackup(ctx context.Context, sources map[string]backup.Source, destinations []namedDestination, dirs []config.DirectoryConfig,
+	keys map[string]*backup.Key, limiter *throttle.Throttle, st *state.State, reconcileAfter time.Duration) {
+	within(ctx, sources, destinations)
+	defer within(context.Background(), sources, destinations)
+	var targets []target
+	for _, dst := range destinations {
+		if ctx.Err() != nil {
+			break
+		}
+		// Generate the list of files already backed up, with their modification times
+		var index *state.Index
+		if st != nil {
+			index = st.Index(dst.name)
+		}
+		backedUp, err := listDestination(dst, index, reconcileAfter)
+		if err != nil {
+			log.Printf("Could not generate %s list, skipping it, %s", dst.name, err)
+			fail(dst.name, "", err)
+			continue
+		}
+		targets = append(targets, target{dst: dst, index: index, backedUp: backedUp})
+	}
+
+	var retries []pendingRetry
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			log.Printf("Stopping, %s. What is left will be picked up next time", context.Cause(ctx))
+			rep.Stop(context.Cause(ctx).Error())
+			break
+		}
+		if len(targets) == 0 {
+			break
+		}
+		src, ok := sources[dir.SourceType()]
+		if !ok {
+			fatalf("No %s source for %s", dir.SourceType(), dir.Dir)
+		}
+		retries = append(retries, backupDir(ctx, dir, src, targets, keys[dir.Dir], countedThrottle{limiter.For(dir.Limits)})...)
+
+		if st != nil && !dryRun {
+			err := st.Save()
+			if err != nil {
+				log.Printf("Could not save what was backed up, it will be listed in full next time, %s", err)
+			}
+		}
+	}
+
+	retryFailed(ctx, retries, st)
+}
+
+// within stops the sources and destinations waiting to retry once ctx is done
+func within(ctx context.Context, sources map[string]backup.Source, destinations []namedDestination) {
+	for _, src := range sources {
+		if bounded, ok := src.(backup.Bounded); ok {
+			bounded.Within(ctx)
+		}
+	}
+	for _, dst := range destinations {
+		if bounded, ok := dst.Destination.(backup.Bounded); ok {
+			bounded.Within(ctx)
+		}
+	}
+}
+
+// backupDir lists dir from the source once, and brings each destination up to date with it
+func backupDir(ctx context.Context, dir config.DirectoryConfig, src backup.Source, targets []target, key *backup.Key,
+	limiter backup.Throttle) []pendingRetry {
+	log.Printf("Checking for changes in %s", dir.Dir)
+	var files []backup.Item
+	var walk iter.Seq2[backup.Item, error]
+	var err error
+	switch dir.Compare {
+	case "", config.CompareModTime:
+		walk, err = walkOnce(src, dir.Dir, len(targets))
+	case config.CompareHash:
+		files, err = src.List(dir.Dir)
+	default:
+		fatalf("Unknown compare %s for %s, expected %s or %s", dir.Compare, dir.Dir, config.CompareModTime, config.CompareHash)
+	}
+	if err != nil {
+		log.Printf("Could not list %s, skipping it, %s", dir.Dir, err)
+		fail("", dir.Dir, err)
+		return nil
+	}
+
+	var retries []pendingRetry
+	sourceFiles := -1
+	changed := make(map[string]bool) // files that needed uploading to any of the destinations
+	for _, t := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("*** comparing changes for %s ***", t.dst.name)
+		var changes, deletions, touched, replaced []backup.Item
+		if walk != nil {
+			// the diff goes through the source as it is listed
+			plan, err := backup.DiffSeq(walk, t.backedUp, dir.Dir)
+			if err != nil {
+				log.Printf("Could not list %s, skipping it, %s", dir.Dir, err)
+				fail("", dir.Dir, err)
+				return retries
+			}
+			log.Printf("%s: %s", dir.Dir, plan.Summary())
+			changes, deletions, replaced, sourceFiles = plan.Uploads(), plan.Deletions(), plan.Replacements(), plan.Files()
+		} else {
+			changes, touched = backup.FindChangesByHash(files, t.backedUp, src)
+			plan := backup.Diff(files, t.backedUp, dir.Dir)
+			deletions, replaced, sourceFiles = plan.Deletions(), plan.Replacements(), plan.Files()
+		}
+		if len(replaced) > 0 {
+			changes = clearReplaced(t, replaced, changes)
+		}
+		for _, item := range changes {
+			changed[item.Path] = true
+		}
+
 		if len(changes) > 0 {
-			log.Printf("Found changes.. [%+v]", changes)
+			log.Printf("Found %d changes", len(changes))
 			if !dryRun {
-				uploadChanges(changes, nc, g, getEncFromConfig(key, conf.Directories), 4)
+				uploaded, failed := backup.UploadChanges(ctx, changes, src, t.dst, key, limiter, 4)
+				if t.index != nil {
+					t.index.Add(uploaded...)
+				}
+				if dir.Compare == config.CompareHash {
+					retag(t, hashedOnUpload(changes, uploaded))
+				}
+				rep.Upload(len(uploaded))
+				if len(failed) > 0 {
+					retries = append(retries, pendingRetry{dst: t.dst, index: t.index, src: src, key: key, limiter: limiter, failed: failed})
+				}
 			}
 		} else {
 			log.Printf("No changes")
 		}
+		if len(touched) > 0 && !dryRun {
+			log.Printf("%d files were touched without changing", len(touched))
+			retag(t, touched)
+		}
+
+		if dir.Mirror != "" {
+			removed := mirror(dir, deletions, sourceFiles, t.dst)
+			if t.index != nil {
+				t.index.Remove(removed...)
+			}
+			rep.Delete(len(removed))
+		}
+	}
+	if sourceFiles >= 0 {
+		// the source is counted once, however many destinations it went to
+		rep.Scan(sourceFiles, sourceFiles-len(changed))
 	}
+	return retries
 }
 
-// my dodgy code means I dont have the enc key when I want it
-func getEncFromConfig(key string, config []config.DirectoryConfig) string {
-	for _, dir := range config {
-		if dir.Dir == key {
-			return dir.Encryption
+// clearReplaced gets what is in the way of a type change out of the destination, and leaves out the
+// uploads it couldn't make room for
+func clearReplaced(t target, replaced, changes []backup.Item) []backup.Item {
+	if dryRun {
+		for _, item := range replaced {
+			log.Printf("Would remove %s, which is in the way", item.Path)
 		}
+		return changes
+	}
+	removed, changes, blocked := backup.ClearReplaced(replaced, changes, t.dst.Destination)
+	if t.index != nil {
+		t.index.Remove(removed...)
 	}
-	log.Panicf("Could not get key for %s", key)
-	return ""
+	for _, failure := range blocked {
+		fail(t.dst.name, failure.Item.Path, failure.Err)
+	}
+	return changes
 }
 
-func uploadChanges(changes []backup.Item, nc *nextcloud.Client, g *gdrive.Client, encryption string, numWorkers int) {
-	log.Printf("Uploading changes with %d workers", numWorkers)
+// retag keeps the hashes and ETags worked out this run with the backups, so the files aren't read again next time
+func retag(t target, items []backup.Item) {
+	if t.index != nil {
+		t.index.Add(items...)
+	}
+	retagger, ok := t.dst.Destination.(backup.Retagger)
+	if !ok {
+		return
+	}
+	for _, item := range items {
+		err := retagger.Retag(item)
+		if err != nil {
+			log.Printf("Could not update %s on %s, it will be read again next time, %s", item.Path, t.dst.name, err)
+		}
+	}
+}
 
-	// Create a channel to receive upload tasks
-	tasks := make(chan backup.Item, len(changes))
+// hashedOnUpload is the uploaded files whose hash was only worked out as they went up, so the
+// destination doesn't have it yet
+func hashedOnUpload(changes, uploaded []backup.Item) []backup.Item {
+	unhashed := make(map[string]bool)
+	for _, item := range changes {
+		if item.Hash == "" {
+			unhashed[item.Path] = true
+		}
+	}
+	var hashed []backup.Item
+	for _, item := range uploaded {
+		if unhashed[item.Path] && item.Hash != "" {
+			hashed = append(hashed, item)
+		}
+	}
+	return hashed
+}
 
-	// Create a wait group to track worker completion
-	var wg sync.WaitGroup
-	wg.Add(numWorkers)
+// walkOnce lists dir for comparing against each of the destinations. With one the diff goes
+// through the listing as it comes, with more it is kept so the source is only listed the once.
+func walkOnce(src backup.Source, dir string, destinations int) (iter.Seq2[backup.Item, error], error) {
+	walk := backup.Walk(src, dir)
+	if destinations <= 1 {
+		return walk, nil
+	}
+	var items []backup.Item
+	for item, err := range walk {
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return func(yield func(backup.Item, error) bool) {
+		for _, item := range items {
+			if !yield(item, nil) {
+				return
+			}
+		}
+	}, nil
+}
 
-	// Start the workers
-	for i := 0; i < numWorkers; i++ {
-		go func() {
-			defer wg.Done()
-			for change := range tasks {
-				f, err := nc.DownloadFile(change.Path)
-				if err != nil {
-					log.Printf("Failed to get file for download: %s", err)
-					continue // Skip to the next file
-				}
+// pendingRetry is the uploads to a destination that failed, kept for another go at the end of the run
+type pendingRetry struct {
+	dst     namedDestination
+	index   *state.Index
+	src     backup.Source
+	key     *backup.Key
+	limiter backup.Throttle
+	failed  []backup.Failure
+}
 
-				if encryption != "" {
-					f, err = backup.Encrypt([]byte(encryption), f)
-					if err != nil {
-						log.Panicf("Failed to encrypt file: %s", err)
-					}
-				}
+// retryFailed has another go at the uploads that failed, now the rest of the run is out of the way,
+// and reports the ones that still didn't make it
+func retryFailed(ctx context.Context, retries []pendingRetry, st *state.State) {
+	if len(retries) == 0 {
+		return
+	}
+	if ctx.Err() == nil {
+		log.Printf("*** retrying failed uploads ***")
+	}
+	var stillFailed, left int
+	for _, r := range retries {
+		uploaded, failed := backup.RetryFailures(ctx, r.failed, r.src, r.dst, r.key, r.limiter, retry.Default)
+		if r.index != nil {
+			r.index.Add(uploaded...)
+		}
+		rep.Upload(len(uploaded))
+		for _, failure := range failed {
+			if ctx.Err() != nil && errors.Is(failure.Err, context.Cause(ctx)) {
+				left++ // cut off by the end of the run rather than failed, it goes next time
+				continue
+			}
+			fail(r.dst.name, failure.Item.Path, failure.Err)
+			stillFailed++
+		}
+	}
+	if stillFailed > 0 {
+		log.Printf("%d files could not be uploaded", stillFailed)
+	}
+	if left > 0 {
+		log.Printf("%d files are left for the next run", left)
+		rep.Leave(left)
+	}
+	if st != nil {
+		err := st.Save()
+		if err != nil {
+			log.Printf("Could not save what was retried, it will be listed in full next time, %s", err)
+		}
+	}
+}
 
-				gfile := gdrive.File{
-					Name:         change.Name,
-					Path:         change.Path,
-					Reader:       f,
-					ModifiedTime: change.ModificationTime,
-				}
+// listDestination gets what the destination has, from the state if there is a recent enough one
+// brought up to date with the destination's changes when it can list them
+func listDestination(dst namedDestination, index *state.Index, reconcileAfter time.Duration) ([]backup.Item, error) {
+	changeLister, canListChanges := dst.Destination.(backup.ChangeLister)
+	if index != nil && !reconcile && !index.Stale(reconcileAfter, time.Now()) {
+		if !canListChanges {
+			log.Printf("Using the saved state for %s", dst.name)
+			return index.Items(), nil
+		}
+		if index.ChangesToken != "" {
+			log.Printf("Getting changes from %s", dst.name)
+			changed, removed, token, err := changeLister.Changes(index.ChangesToken)
+			if err == nil {
+				err = index.Apply(changed, removed)
+			}
+			if err == nil {
+				log.Printf("%d changed and %d removed on %s", len(changed), len(removed), dst.name)
+				index.ChangesToken = token
+				return index.Items(), nil
+			}
+			log.Printf("Listing %s in full, %s", dst.name, err)
+		}
+	}
 
-				err = g.UploadFile(gfile)
-				f.Close()
-				if err != nil {
-					log.Printf("Failed to upload file: %s", err)
-					continue // Skip to the next file
-				}
-				log.Printf("Uploaded %s", change.Name)
+	var token string
+	if index != nil && canListChanges {
+		var err error
+		token, err = changeLister.StartToken()
+		if err != nil {
+			log.Printf("Could not get a changes token from %s, %s", dst.name, err)
+		}
+	}
+	log.Printf("Searching %s", dst.name)
+	items, err := dst.List()
+	if err != nil {
+		return nil, err
+	}
+	if index != nil {
+		index.Reconcile(items, time.Now())
+		index.ChangesToken = token
+	}
+	return items, nil
+}
+
+// mirror removes the files that have gone from the source since they were backed up, returning the ones it removed
+func mirror(dir config.DirectoryConfig, deletions []backup.Item, sourceFiles int, dst namedDestination) []backup.Item {
+	if len(deletions) == 0 {
+		return nil
+	}
+	if sourceFiles == 0 {
+		log.Printf("Not mirroring %s, the source is empty which is more likely a problem than a clear out", dir.Dir)
+		return nil
+	}
+	log.Printf("Found %d files removed from %s", len(deletions), dir.Dir)
+	if dryRun {
+		for _, item := range deletions {
+			log.Printf("Would remove %s", item.Path)
+		}
+		return nil
+	}
+
+	maxDeletes := dir.MirrorMaxDeletes
+	if maxDeletes == 0 {
+		maxDeletes = backup.DefaultMaxDeletes
+	}
+	deleted, err := backup.DeleteRemoved(deletions, dst.Destination, dir.Mirror == config.MirrorDelete, maxDeletes)
+	if err != nil {
+		log.Printf("Could not mirror %s to %s, %s", dir.Dir, dst.name, err)
+		fail(dst.name, dir.Dir, fmt.Errorf("could not mirror, %w", err))
+		return nil
+	}
+	log.Printf("Removed %d files from %s", len(deleted), dst.name)
+	return deleted
+}
+
+// namedDestination is a destination along with its name from the config
+type namedDestination struct {
+	backup.Destination
+	name string
+}
+
+// connectDestinations sets up every destination in the config, in order
+func connectDestinations(confs []config.DestinationConfig, googleBaseFolder string, keepVersions bool, sessions backup.SessionStore) ([]namedDestination, error) {
+	var destinations []namedDestination
+	names := make(map[string]bool)
+	for _, conf := range confs {
+		name := conf.Name
+		if name == "" {
+			name = conf.Type
+		}
+		if names[name] {
+			return nil, fmt.Errorf("there is more than one destination called %s", name)
+		}
+		names[name] = true
+
+		var dst backup.Destination
+		var err error
+		switch conf.Type {
+		case config.DestinationGoogle:
+			log.Printf("Connecting to google")
+			var client *gdrive.Client
+			baseFolder := conf.BaseFolder
+			if baseFolder == "" {
+				baseFolder = googleBaseFolder
+			}
+			if baseFolder == "" {
+				baseFolder = conf.DriveID // the top of the Shared Drive has the drive's ID
 			}
-		}()
+			if conf.ServiceAccountKey != "" {
+				client, err = gdrive.NewServiceAccountClient(baseFolder, conf.ServiceAccountKey, conf.Subject)
+			} else {
+				client, err = gdrive.NewClient(baseFolder)
+			}
+			if err == nil {
+				client.DriveID = conf.DriveID
+				client.KeepVersions = keepVersions
+				client.ChunkSize = conf.PartSizeMB * 1024 * 1024
+				client.Sessions = sessions
+				dst = client
+			}
+		case config.DestinationLocal:
+			dst, err = local.NewDestination(conf.Path)
+		case config.DestinationWebDAV:
+			log.Printf("Connecting to %s", conf.Address)
+			var client *nextcloud.Client
+			client, err = nextcloud.NewClientWithAuth(conf.Address, conf.Username, conf.Password)
+			if err == nil {
+				dst = nextcloud.NewDestination(client, conf.Path)
+			}
+		case config.DestinationS3:
+			var client *s3.Client
+			client, err = s3.NewClient(conf.Address, conf.Region, conf.Bucket, conf.AccessKey, conf.SecretKey)
+			if err == nil {
+				dst = s3.NewDestination(client, conf.Path, conf.PartSizeMB*1024*1024)
+			}
+		default:
+			err = fmt.Errorf("unknown type %s", conf.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		destinations = append(destinations, namedDestination{Destination: dst, name: name})
+	}
+	return destinations, nil
+}
+
+// connectSources sets up the sources the directories need, keyed by config.DirectoryConfig.SourceType
+func connectSources(dirs []config.DirectoryConfig) (map[string]backup.Source, error) {
+	sources := make(map[string]backup.Source)
+	for _, dir := range dirs {
+		if _, ok := sources[dir.SourceType()]; ok {
+			continue
+		}
+		switch dir.SourceType() {
+		case config.SourceNextcloud:
+			log.Printf("Connecting to nextcloud")
+			nc, err := nextcloud.NewClient()
+			if err != nil {
+				return nil, err
+			}
+			sources[config.SourceNextcloud] = nc
+		case config.SourceLocal:
+			sources[config.SourceLocal] = local.NewSource()
+		default:
+			return nil, fmt.Errorf("unknown source %s for %s", dir.Source, dir.Dir)
+		}
 	}
+	return sources, nil
+}
 
-	// Send the upload tasks to the channel
-	for _, change := range changes {
-		tasks <- change
+// loadKeys gets the encryption key for each directory, ones without encryption are left out
+func loadKeys(dirs []config.DirectoryConfig) (map[string]*backup.Key, error) {
+	keys := make(map[string]*backup.Key)
+	for _, dir := range dirs {
+		key, err := backup.LoadKey(dir)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", dir.Dir, err)
+		}
+		if key != nil {
+			keys[dir.Dir] = key
+		}
 	}
-	close(tasks)
+	return keys, nil
+}
+
+// countedThrottle adds what is read for upload to the report, which is what went over the network
+// rather than the size of the files
+type countedThrottle struct {
+	backup.Throttle
+}
+
+func (t countedThrottle) Upload(reader io.ReadCloser) io.ReadCloser {
+	return &countingReader{ReadCloser: t.Throttle.Upload(reader)}
+}
+
+type countingReader struct {
+	io.ReadCloser
+}
 
-	// Wait for all workers to finish
-	wg.Wait()
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	rep.Sent(int64(n))
+	return n, err
 }
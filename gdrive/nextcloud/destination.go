@@ -0,0 +1,73 @@
+package nextcloud
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+)
+
+// Destination keeps backups in a folder on a WebDAV server, such as a second nextcloud or a NAS
+type Destination struct {
+	client *Client
+	root   string
+}
+
+func NewDestination(client *Client, root string) *Destination {
+	return &Destination{client: client, root: "/" + strings.Trim(root, "/")}
+}
+
+func (d *Destination) Within(ctx context.Context) {
+	d.client.Within(ctx)
+}
+
+func (d *Destination) List() ([]backup.Item, error) {
+	files, err := d.client.ListAllFiles(d.root)
+	if err != nil {
+		return nil, err
+	}
+	var items []backup.Item
+	for _, file := range files {
+		if isPartial(file.Name()) {
+			continue
+		}
+		item := toItem(file)
+		item.ID = file.Path
+		item.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(file.Path, d.root), "/")
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (d *Destination) EnsureFolder(folderPath string) error {
+	err := d.client.client.MkdirAll(d.fullPath(folderPath), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create folder %s, %w", folderPath, err)
+	}
+	return nil
+}
+
+// Put uploads to a temporary name and then moves it over the old copy, so the old one is only replaced once the new one is safe
+func (d *Destination) Put(item backup.Item, reader io.Reader) error {
+	return d.client.UploadFile(d.fullPath(item.Path), reader, item.ModificationTime)
+}
+
+func (d *Destination) Delete(item backup.Item) error {
+	err := d.client.client.Remove(d.fullPath(item.Path))
+	if err != nil {
+		return fmt.Errorf("could not delete %s, %w", item.Path, err)
+	}
+	return nil
+}
+
+func (d *Destination) Get(item backup.Item) (io.ReadCloser, error) {
+	return d.client.DownloadFile(d.fullPath(item.Path))
+}
+
+// fullPath puts a backup path under the root, cleaning it first so it can't climb out
+func (d *Destination) fullPath(itemPath string) string {
+	return path.Join(d.root, path.Clean("/"+itemPath))
+}
@@ -0,0 +1,174 @@
+package nextcloud
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func TestDestination(t *testing.T) {
+	server := httptest.NewServer(&webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()})
+	defer server.Close()
+	client, err := NewClientWithAuth(server.URL, "user", "pass")
+	require.NoError(t, err)
+	dst := NewDestination(client, "/backups/")
+
+	item := backup.Item{Path: "/docs/notes.txt", Name: "notes.txt", ModificationTime: time.Now()}
+	require.NoError(t, dst.EnsureFolder("/docs"))
+	require.NoError(t, dst.Put(item, strings.NewReader("first")))
+	require.NoError(t, dst.Put(item, strings.NewReader("second")))
+
+	items, err := dst.List()
+	require.NoError(t, err)
+	sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+	require.Len(t, items, 2)
+	require.Equal(t, "/docs", items[0].Path)
+	require.Equal(t, "/docs/notes.txt", items[1].Path)
+	require.EqualValues(t, 6, items[1].Size)
+
+	f, err := dst.Get(items[1])
+	require.NoError(t, err)
+	b, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	require.Equal(t, "second", string(b))
+
+	require.NoError(t, dst.Delete(items[1]))
+	items, err = dst.List()
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+
+	// a file that happens to end in .partial is backed up like any other, a leftover upload isn't
+	partial := backup.Item{Path: "/docs/x.partial", Name: "x.partial", ModificationTime: time.Now()}
+	require.NoError(t, dst.Put(partial, strings.NewReader("real")))
+	require.NoError(t, client.UploadFile(partialName("/backups/docs/notes.txt"), strings.NewReader("cut short"), time.Now()))
+	items, err = dst.List()
+	require.NoError(t, err)
+	sort.Slice(items, func(i, j int) bool { return items[i].Path < items[j].Path })
+	require.Len(t, items, 2)
+	require.Equal(t, "/docs/x.partial", items[1].Path)
+}
+
+func TestDestinationKeepsModTime(t *testing.T) {
+	// a plain WebDAV server, which keeps the upload time unless it is told otherwise
+	server := httptest.NewServer(&webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()})
+	defer server.Close()
+	client, err := NewClientWithAuth(server.URL, "user", "pass")
+	require.NoError(t, err)
+	dst := NewDestination(client, "/backups")
+
+	modTime := time.Date(2024, 7, 14, 10, 30, 0, 0, time.UTC)
+	require.NoError(t, dst.Put(backup.Item{Path: "/notes.txt", Name: "notes.txt", ModificationTime: modTime}, strings.NewReader("hello")))
+	items, err := dst.List()
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.True(t, items[0].ModificationTime.Equal(modTime), items[0].ModificationTime)
+}
+
+// noInfinity turns down whole tree listings, like nextcloud does unless it's been allowed
+type noInfinity struct {
+	http.Handler
+	lock   sync.Mutex
+	depths []string
+}
+
+func (h *noInfinity) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PROPFIND" {
+		h.lock.Lock()
+		h.depths = append(h.depths, r.Header.Get("Depth"))
+		h.lock.Unlock()
+		if r.Header.Get("Depth") == "infinity" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestWalk(t *testing.T) {
+	fs := webdav.NewMemFS()
+	handler := &noInfinity{Handler: &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	ctx := context.Background()
+	for _, dir := range []string{"/files", "/files/a", "/files/a/b", "/files/c"} {
+		require.NoError(t, fs.Mkdir(ctx, dir, 0755))
+	}
+	for _, name := range []string{"/files/top.txt", "/files/a/one.txt", "/files/a/b/two.txt", "/files/c/three.txt"} {
+		f, err := fs.OpenFile(ctx, name, os.O_CREATE|os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		f.Write([]byte(name))
+		f.Close()
+	}
+	expected := []string{"/files/a", "/files/a/b", "/files/a/b/two.txt", "/files/a/one.txt", "/files/c", "/files/c/three.txt", "/files/top.txt"}
+
+	client, err := NewClientWithAuth(server.URL, "user", "pass")
+	require.NoError(t, err)
+	handler.depths = nil
+	files, err := client.ListAllFiles("/files")
+	require.NoError(t, err)
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+	require.ElementsMatch(t, expected, paths)
+	require.Equal(t, "infinity", handler.depths[0], "whole tree tried first")
+	require.Equal(t, []string{"1", "1", "1", "1"}, handler.depths[1:], "then each folder")
+
+	// stopping early is fine
+	for item, err := range client.Walk("/files") {
+		require.NoError(t, err)
+		require.Contains(t, expected, item.Path)
+		break
+	}
+
+	// and it reads the whole tree when depth infinity is allowed
+	server.Config.Handler = handler.Handler
+	files, err = client.ListAllFiles("/files/")
+	require.NoError(t, err)
+	require.Len(t, files, len(expected))
+	for _, file := range files {
+		if file.Path == "/files/a/b/two.txt" {
+			require.EqualValues(t, len(file.Path), file.Size())
+			require.False(t, file.IsDir())
+			require.NotEmpty(t, toItem(file).ETag)
+		}
+	}
+}
+
+func TestOpenAt(t *testing.T) {
+	fs := webdav.NewMemFS()
+	davHandler := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	ignoreRange := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ignoreRange {
+			r.Header.Del("Range")
+		}
+		davHandler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client, err := NewClientWithAuth(server.URL, "user", "pass")
+	require.NoError(t, err)
+	require.NoError(t, client.UploadFile("/notes.txt", strings.NewReader("0123456789"), time.Now()))
+
+	for _, ignore := range []bool{false, true} {
+		ignoreRange = ignore
+		f, err := client.OpenAt("/notes.txt", 4)
+		require.NoError(t, err)
+		b, err := io.ReadAll(f)
+		f.Close()
+		require.NoError(t, err)
+		require.Equal(t, "456789", string(b), "ignoring the range: %v", ignore)
+	}
+}
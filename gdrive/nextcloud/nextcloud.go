@@ -1,13 +1,21 @@
 package nextcloud
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"net/http"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/retry"
 	"github.com/studio-b12/gowebdav"
 )
 
@@ -19,6 +27,9 @@ type auth struct {
 
 type Client struct {
 	client *gowebdav.Client
+	auth   auth
+	http   *http.Client
+	retry  *retry.Transport
 }
 
 func getAuth() (auth, error) {
@@ -47,19 +58,32 @@ func NewClient() (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	return NewClientWithAuth(authDetails.Address, authDetails.Username, authDetails.Password)
+}
+
+// NewClientWithAuth connects to any WebDAV server, not just the nextcloud in nextcloud.json
+func NewClientWithAuth(address, username, password string) (*Client, error) {
+	authDetails := auth{Address: address, Username: username, Password: password}
 	client := gowebdav.NewClient(authDetails.Address, authDetails.Username, authDetails.Password)
-	err = client.Connect()
+	transport := retry.NewTransport(nil)
+	client.SetTransport(transport)
+	err := client.Connect()
 	if err != nil {
 		return nil, fmt.Errorf("error connecting: %s", err)
 	}
 
-	return &Client{client: client}, nil
+	return &Client{client: client, auth: authDetails, http: &http.Client{Transport: transport}, retry: transport}, nil
+}
+
+// Within stops the waits between retries once ctx is done
+func (c *Client) Within(ctx context.Context) {
+	c.retry.Within(ctx)
 }
 
 func (c *Client) ListFiles(dir string) ([]ExtraFileInfo, error) {
 	files, err := c.client.ReadDir(dir)
 	if err != nil {
-		return nil, fmt.Errorf("could not read directory, %s", err)
+		return nil, fmt.Errorf("could not read directory, %w", err)
 	}
 	cov := make([]ExtraFileInfo, len(files))
 	for i, file := range files {
@@ -78,20 +102,15 @@ type ExtraFileInfo struct {
 	Path string
 }
 
+// ListAllFiles returns everything below dir, use Walk instead to go through big trees as they are listed
 func (c *Client) ListAllFiles(dir string) ([]ExtraFileInfo, error) {
 	log.Printf("Looking at %s", dir)
-	files, err := c.ListFiles(dir)
-	if err != nil {
-		return nil, err
-	}
-	for _, file := range files {
-		if file.IsDir() {
-			extraFiles, err := c.ListAllFiles(file.Path)
-			if err != nil {
-				return nil, err
-			}
-			files = append(files, extraFiles...)
+	var files []ExtraFileInfo
+	for file, err := range c.walk(dir) {
+		if err != nil {
+			return nil, err
 		}
+		files = append(files, file)
 	}
 	return files, nil
 }
@@ -99,8 +118,108 @@ func (c *Client) ListAllFiles(dir string) ([]ExtraFileInfo, error) {
 func (c *Client) DownloadFile(path string) (io.ReadCloser, error) {
 	reader, err := c.client.ReadStream(path)
 	if err != nil {
-		return nil, fmt.Errorf("could not open file, %s", err)
+		return nil, fmt.Errorf("could not open file, %w", err)
 	}
 
 	return reader, nil
 }
+
+// UploadFile writes the reader to path, creating any missing folders on the way. It goes to a temporary
+// name next to path first and is moved into place once all of it is there, so a failed upload, or a
+// restore that turns out to be damaged part way through, never leaves half a file over the old one.
+func (c *Client) UploadFile(filePath string, reader io.Reader, modTime time.Time) error {
+	err := c.client.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return fmt.Errorf("could not create folder for %s, %w", filePath, err)
+	}
+	tmp := partialName(filePath)
+	err = c.put(tmp, reader, modTime)
+	if err != nil {
+		c.client.Remove(tmp)
+		return err
+	}
+	err = c.client.Rename(tmp, filePath, true)
+	if err != nil {
+		c.client.Remove(tmp)
+		return fmt.Errorf("could not replace %s, %w", filePath, err)
+	}
+	return nil
+}
+
+// partialName is where UploadFile uploads filePath to before moving it into place
+func partialName(filePath string) string {
+	return path.Join(path.Dir(filePath), "."+path.Base(filePath)+".partial")
+}
+
+// isPartial says if name is one of UploadFile's temporary files, rather than a file of ours that ends in .partial
+func isPartial(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".partial")
+}
+
+// put writes the reader to filePath. The modification time is passed with the X-OC-MTime header,
+// which Nextcloud uses instead of the upload time. Other servers keep the upload time, so it is
+// set as a property of our own there instead, which listing prefers.
+func (c *Client) put(filePath string, reader io.Reader, modTime time.Time) error {
+	headers := make(map[string]string)
+	if !modTime.IsZero() {
+		headers["X-OC-MTime"] = strconv.FormatInt(modTime.Unix(), 10)
+	}
+	resp, err := c.request(http.MethodPut, filePath, reader, headers)
+	if err != nil {
+		return fmt.Errorf("could not upload %s, %w", filePath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("could not upload %s, %w", filePath, &retry.StatusError{StatusCode: resp.StatusCode, Header: resp.Header})
+	}
+	if !modTime.IsZero() && resp.Header.Get("X-OC-MTime") != "accepted" {
+		return c.setModTime(filePath, modTime)
+	}
+	return nil
+}
+
+// mtimeNamespace is what our modification time property is kept under
+const mtimeNamespace = "https://github.com/ProjectOrangeJuice/gdrive-backup"
+
+// setModTime keeps modTime in a dead property, for servers that don't take X-OC-MTime. Without it
+// every file would look changed on the next run and be uploaded again.
+func (c *Client) setModTime(filePath string, modTime time.Time) error {
+	body := `<?xml version="1.0"?>
+<d:propertyupdate xmlns:d="DAV:" xmlns:b="` + mtimeNamespace + `">
+	<d:set><d:prop><b:mtime>` + strconv.FormatInt(modTime.Unix(), 10) + `</b:mtime></d:prop></d:set>
+</d:propertyupdate>`
+	resp, err := c.request("PROPPATCH", filePath, strings.NewReader(body), map[string]string{"Content-Type": "application/xml"})
+	if err != nil {
+		return fmt.Errorf("could not keep the modification time of %s, %w", filePath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return fmt.Errorf("could not keep the modification time of %s, %w", filePath, &retry.StatusError{StatusCode: resp.StatusCode, Header: resp.Header})
+	}
+	var result struct {
+		Statuses []string `xml:"response>propstat>status"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return fmt.Errorf("could not keep the modification time of %s, %s", filePath, err)
+	}
+	for _, status := range result.Statuses {
+		if !strings.Contains(status, "200") {
+			return fmt.Errorf("could not keep the modification time of %s, the server said %s", filePath, status)
+		}
+	}
+	return nil
+}
+
+// request sends a raw request for the WebDAV calls gowebdav doesn't let us customise
+func (c *Client) request(method, filePath string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, gowebdav.PathEscape(gowebdav.Join(c.auth.Address, filePath)), body)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.auth.Username, c.auth.Password)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return c.http.Do(req)
+}
@@ -1,9 +1,17 @@
 package nextcloud
 
 import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+	"golang.org/x/net/webdav"
 )
 
 func TestFileList(t *testing.T) {
@@ -19,3 +27,88 @@ func TestFileList(t *testing.T) {
 
 	t.Fail()
 }
+
+func TestUploadFileKeepsModTime(t *testing.T) {
+	modTime := time.Date(2024, 7, 14, 10, 30, 0, 0, time.UTC)
+	var gotPath, gotMTime, gotBody, movedTo string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "MKCOL":
+			w.WriteHeader(http.StatusMethodNotAllowed) // already exists
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			gotPath, gotMTime, gotBody = r.URL.Path, r.Header.Get("X-OC-MTime"), string(body)
+			w.Header().Set("X-OC-MTime", "accepted")
+			w.WriteHeader(http.StatusCreated)
+		case "MOVE":
+			movedTo = r.Header.Get("Destination")
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	c := &Client{
+		client: gowebdav.NewClient(server.URL, "user", "pass"),
+		auth:   auth{Address: server.URL, Username: "user", Password: "pass"},
+		http:   server.Client(),
+	}
+	err := c.UploadFile("/restored/a b.txt", strings.NewReader("hello"), modTime)
+	require.NoError(t, err)
+	require.Equal(t, "/restored/.a b.txt.partial", gotPath, "uploaded beside it first")
+	require.Equal(t, "1720953000", gotMTime)
+	require.Equal(t, "hello", gotBody)
+	require.Equal(t, server.URL+"/restored/a%20b.txt", movedTo)
+}
+
+// damaged fails part way through, like a backup that doesn't decrypt
+type damaged struct{ io.Reader }
+
+func (d damaged) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	if err == io.EOF {
+		return n, errors.New("message authentication failed")
+	}
+	return n, err
+}
+
+func TestUploadFileLeavesOldCopy(t *testing.T) {
+	server := httptest.NewServer(&webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()})
+	defer server.Close()
+	c, err := NewClientWithAuth(server.URL, "user", "pass")
+	require.NoError(t, err)
+
+	require.NoError(t, c.UploadFile("/docs/notes.txt", strings.NewReader("mine"), time.Now()))
+	err = c.UploadFile("/docs/notes.txt", damaged{strings.NewReader("half of a restore")}, time.Now())
+	require.Error(t, err)
+
+	f, err := c.DownloadFile("/docs/notes.txt")
+	require.NoError(t, err)
+	b, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	require.Equal(t, "mine", string(b), "the old copy is still there")
+}
+
+func TestHash(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "PROPFIND", r.Method)
+		w.WriteHeader(http.StatusMultiStatus)
+		checksums := "SHA1:da39a3ee MD5:d41d8cd9"
+		if r.URL.Path == "/with.txt" {
+			checksums += " SHA256:E3B0C442"
+		}
+		io.WriteString(w, `<?xml version="1.0"?>
+<d:multistatus xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns"><d:response><d:href>`+r.URL.Path+`</d:href>
+<d:propstat><d:prop><oc:checksums><oc:checksum>`+checksums+`</oc:checksum></oc:checksums></d:prop>
+<d:status>HTTP/1.1 200 OK</d:status></d:propstat></d:response></d:multistatus>`)
+	}))
+	defer server.Close()
+
+	c := &Client{auth: auth{Address: server.URL}, http: server.Client()}
+	hash, err := c.Hash("/with.txt")
+	require.NoError(t, err)
+	require.Equal(t, "e3b0c442", hash)
+	hash, err = c.Hash("/without.txt")
+	require.NoError(t, err)
+	require.Empty(t, hash)
+}
@@ -0,0 +1,107 @@
+package nextcloud
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/retry"
+)
+
+// List returns everything below dir as backup items, so the client can be used as a backup.Source
+func (c *Client) List(dir string) ([]backup.Item, error) {
+	files, err := c.ListAllFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]backup.Item, len(files))
+	for index, file := range files {
+		items[index] = toItem(file)
+	}
+	return items, nil
+}
+
+func (c *Client) Stat(filePath string) (backup.Item, error) {
+	file, err := c.client.Stat(filePath)
+	if err != nil {
+		return backup.Item{}, fmt.Errorf("could not stat %s, %w", filePath, err)
+	}
+	return toItem(ExtraFileInfo{FileInfo: file, Path: filePath}), nil
+}
+
+func (c *Client) Open(filePath string) (io.ReadCloser, error) {
+	return c.DownloadFile(filePath)
+}
+
+// OpenAt opens the file part way in, for carrying on with an upload. Servers that ignore the
+// range send the whole file, so what comes before offset is skipped here instead.
+func (c *Client) OpenAt(filePath string, offset int64) (io.ReadCloser, error) {
+	resp, err := c.request(http.MethodGet, filePath, nil, map[string]string{"Range": fmt.Sprintf("bytes=%d-", offset)})
+	if err != nil {
+		return nil, fmt.Errorf("could not open file at %d, %w", offset, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("could not skip to %d in %s, %w", offset, filePath, err)
+		}
+		return resp.Body, nil
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("could not open file at %d, %w", offset, &retry.StatusError{StatusCode: resp.StatusCode, Header: resp.Header})
+}
+
+const checksumPropfind = `<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+	<d:prop><oc:checksums/></d:prop>
+</d:propfind>`
+
+// Hash returns the SHA256 checksum nextcloud has for the file. Nextcloud only has the checksums
+// that clients sent when uploading, so this is empty more often than not.
+func (c *Client) Hash(filePath string) (string, error) {
+	resp, err := c.request("PROPFIND", filePath, strings.NewReader(checksumPropfind), map[string]string{"Depth": "0", "Content-Type": "application/xml"})
+	if err != nil {
+		return "", fmt.Errorf("could not get checksums for %s, %s", filePath, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return "", fmt.Errorf("could not get checksums for %s, server said %s", filePath, resp.Status)
+	}
+
+	var result struct {
+		Checksums []string `xml:"response>propstat>prop>checksums>checksum"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("could not read checksums for %s, %s", filePath, err)
+	}
+	// they come as a space separated list, like SHA1:... MD5:... SHA256:...
+	for _, checksums := range result.Checksums {
+		for _, checksum := range strings.Fields(checksums) {
+			if hash, ok := strings.CutPrefix(checksum, "SHA256:"); ok {
+				return strings.ToLower(hash), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func toItem(file ExtraFileInfo) backup.Item {
+	item := backup.Item{
+		Name:             file.Name(),
+		Path:             file.Path,
+		ModificationTime: file.ModTime(),
+		Dir:              file.IsDir(),
+		Size:             file.Size(),
+	}
+	if f, ok := file.FileInfo.(interface{ ETag() string }); ok {
+		item.ETag = f.ETag()
+	}
+	return item
+}
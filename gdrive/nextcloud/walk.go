@@ -0,0 +1,262 @@
+package nextcloud
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/retry"
+)
+
+const (
+	walkWorkers  = 8 // folders listed at once when the server won't do it in one go
+	walkPropfind = `<?xml version="1.0"?>
+<d:propfind xmlns:d="DAV:">
+	<d:prop><d:resourcetype/><d:getcontentlength/><d:getetag/><d:getlastmodified/><b:mtime xmlns:b="` + mtimeNamespace + `"/></d:prop>
+</d:propfind>`
+)
+
+// errNoInfinity is when the server won't list a whole tree in one request, nextcloud only does if it's turned on
+var errNoInfinity = fmt.Errorf("server does not allow depth infinity")
+
+// Walk goes through everything below dir as backup items, so diffing can start before the listing ends
+func (c *Client) Walk(dir string) iter.Seq2[backup.Item, error] {
+	return func(yield func(backup.Item, error) bool) {
+		for file, err := range c.walk(dir) {
+			if err != nil {
+				yield(backup.Item{}, err)
+				return
+			}
+			if !yield(toItem(file), nil) {
+				return
+			}
+		}
+	}
+}
+
+// walk goes through everything below dir. It asks for the whole tree in one request, and if the
+// server won't do that, lists walkWorkers folders at a time.
+func (c *Client) walk(dir string) iter.Seq2[ExtraFileInfo, error] {
+	dir = "/" + strings.Trim(dir, "/")
+	return func(yield func(ExtraFileInfo, error) bool) {
+		stopped := false
+		err := c.propfind(dir, "infinity", func(file ExtraFileInfo) bool {
+			stopped = !yield(file, nil)
+			return !stopped
+		})
+		if err == errNoInfinity {
+			c.walkFolders(dir, yield)
+			return
+		}
+		if err != nil && !stopped {
+			yield(ExtraFileInfo{}, err)
+		}
+	}
+}
+
+// walkFolders lists one folder at a time per worker, handing on files as they come in. The workers
+// take folders off a queue, so a big tree is walkWorkers goroutines rather than one for each folder.
+func (c *Client) walkFolders(dir string, yield func(ExtraFileInfo, error) bool) {
+	type result struct {
+		file ExtraFileInfo
+		err  error
+	}
+	results := make(chan result)
+	done := make(chan struct{})
+	defer close(done)
+	var (
+		lock    sync.Mutex
+		wake    = sync.NewCond(&lock)
+		queue   = []string{dir}
+		busy    int // workers listing a folder, that could add more to the queue
+		stopped bool
+		wg      sync.WaitGroup
+	)
+
+	worker := func() {
+		defer wg.Done()
+		lock.Lock()
+		defer lock.Unlock()
+		for {
+			for len(queue) == 0 && busy > 0 && !stopped {
+				wake.Wait()
+			}
+			if len(queue) == 0 || stopped {
+				wake.Broadcast() // so the others see it is finished too
+				return
+			}
+			folder := queue[len(queue)-1]
+			queue = queue[:len(queue)-1]
+			busy++
+			lock.Unlock()
+
+			var folders []string
+			err := c.propfind(folder, "1", func(file ExtraFileInfo) bool {
+				if file.IsDir() {
+					folders = append(folders, file.Path)
+				}
+				select {
+				case results <- result{file: file}:
+					return true
+				case <-done:
+					return false
+				}
+			})
+			if err != nil {
+				select {
+				case results <- result{err: err}:
+				case <-done:
+				}
+			}
+
+			lock.Lock()
+			busy--
+			queue = append(queue, folders...)
+			select {
+			case <-done:
+				stopped = true // nobody wants the rest
+			default:
+				stopped = stopped || err != nil
+			}
+			wake.Broadcast()
+		}
+	}
+	wg.Add(walkWorkers)
+	for i := 0; i < walkWorkers; i++ {
+		go worker()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	for r := range results {
+		if !yield(r.file, r.err) || r.err != nil {
+			return
+		}
+	}
+}
+
+type davResponse struct {
+	Href     string `xml:"href"`
+	Propstat []struct {
+		Status string `xml:"status"`
+		Prop   struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"collection"`
+			} `xml:"resourcetype"`
+			ContentLength string `xml:"getcontentlength"`
+			ETag          string `xml:"getetag"`
+			LastModified  string `xml:"getlastmodified"`
+			ModTime       string `xml:"https://github.com/ProjectOrangeJuice/gdrive-backup mtime"` // see setModTime
+		} `xml:"prop"`
+	} `xml:"propstat"`
+}
+
+// propfind lists dir to the depth asked for, passing each entry below it to found as the response is read.
+// found returns false to stop.
+func (c *Client) propfind(dir, depth string, found func(ExtraFileInfo) bool) error {
+	resp, err := c.request("PROPFIND", dir, strings.NewReader(walkPropfind), map[string]string{"Depth": depth, "Content-Type": "application/xml"})
+	if err != nil {
+		return fmt.Errorf("could not read directory %s, %w", dir, err)
+	}
+	defer resp.Body.Close()
+	if depth == "infinity" && resp.StatusCode != http.StatusMultiStatus && resp.StatusCode != http.StatusUnauthorized &&
+		resp.StatusCode != http.StatusNotFound {
+		return errNoInfinity
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return fmt.Errorf("could not read directory %s, %w", dir, &retry.StatusError{StatusCode: resp.StatusCode, Header: resp.Header})
+	}
+
+	root := ""
+	if u, err := url.Parse(c.auth.Address); err == nil {
+		root = strings.TrimSuffix(u.Path, "/")
+	}
+	// read a response at a time, so a huge tree is never all in memory
+	decoder := xml.NewDecoder(resp.Body)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read directory %s, %s", dir, err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "response" {
+			continue
+		}
+		var r davResponse
+		err = decoder.DecodeElement(&r, &start)
+		if err != nil {
+			return fmt.Errorf("could not read directory %s, %s", dir, err)
+		}
+		file, ok := r.file(root)
+		if !ok || file.Path == dir {
+			continue
+		}
+		if !found(file) {
+			return nil
+		}
+	}
+}
+
+// file turns a response into a file, root is the part of the href before the WebDAV paths start
+func (r davResponse) file(root string) (ExtraFileInfo, bool) {
+	u, err := url.Parse(r.Href)
+	if err != nil {
+		return ExtraFileInfo{}, false
+	}
+	filePath := "/" + strings.Trim(strings.TrimPrefix(u.Path, root), "/")
+	for _, propstat := range r.Propstat {
+		if !strings.Contains(propstat.Status, "200") {
+			continue
+		}
+		info := davFile{
+			name:  path.Base(filePath),
+			isDir: propstat.Prop.ResourceType.Collection != nil,
+			etag:  propstat.Prop.ETag,
+		}
+		info.size, _ = strconv.ParseInt(propstat.Prop.ContentLength, 10, 64)
+		info.modTime, _ = time.Parse(time.RFC1123, propstat.Prop.LastModified)
+		if seconds, err := strconv.ParseInt(propstat.Prop.ModTime, 10, 64); err == nil {
+			info.modTime = time.Unix(seconds, 0)
+		}
+		return ExtraFileInfo{FileInfo: info, Path: filePath}, true
+	}
+	return ExtraFileInfo{}, false
+}
+
+// davFile is what a PROPFIND tells us about a file
+type davFile struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+	etag    string
+}
+
+func (f davFile) Name() string       { return f.name }
+func (f davFile) Size() int64        { return f.size }
+func (f davFile) ModTime() time.Time { return f.modTime }
+func (f davFile) IsDir() bool        { return f.isDir }
+func (f davFile) Sys() any           { return nil }
+func (f davFile) ETag() string       { return f.etag }
+
+func (f davFile) Mode() fs.FileMode {
+	if f.isDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
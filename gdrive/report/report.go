@@ -0,0 +1,197 @@
+// Package report keeps count of what a run did, so it can be written out for whatever runs us to check
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exit codes, so cron and systemd can tell a run that mostly worked from one that didn't get going
+const (
+	ExitSuccess = 0
+	ExitFatal   = 1
+	ExitPartial = 2
+	// a destination's sign in was revoked or ran out, someone has to authorize it again
+	ExitReauthorize = 3
+)
+
+const (
+	StatusSuccess = "success"
+	StatusPartial = "partial"
+	StatusFatal   = "fatal"
+	// StatusReauthorize is a destination that won't work until it is signed in to again
+	StatusReauthorize = "reauthorize"
+)
+
+// Report is what a run did
+type Report struct {
+	lock sync.Mutex
+
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Status          string    `json:"status"`
+
+	Scanned       int   `json:"scanned"`       // files looked at in the sources
+	Uploaded      int   `json:"uploaded"`      // files that went up
+	Skipped       int   `json:"skipped"`       // files that didn't need uploading to any destination
+	Failed        int   `json:"failed"`        // files that didn't go up, or whole directories and destinations that couldn't be listed
+	Deleted       int   `json:"deleted"`       // files removed from destinations because they went from the source
+	Remaining     int   `json:"remaining"`     // files that needed uploading but the run stopped before they went
+	BytesUploaded int64 `json:"bytesUploaded"` // what went over the network
+
+	Stopped          string    `json:"stopped,omitempty"`     // why the run stopped early, if it did without anything going wrong
+	Fatal            string    `json:"fatal,omitempty"`       // what stopped the run from going any further
+	NeedsReauthorize []string  `json:"reauthorize,omitempty"` // destinations that need signing in to again
+	Failures         []Failure `json:"failures"`
+}
+
+// Failure is something that didn't work, Path is a file, a directory, or empty if a whole destination failed.
+// Destination is empty when it was the source that failed.
+type Failure struct {
+	Destination string `json:"destination"`
+	Path        string `json:"path"`
+	Error       string `json:"error"`
+}
+
+func New(started time.Time) *Report {
+	return &Report{Started: started, Failures: []Failure{}}
+}
+
+func (r *Report) Scan(scanned, skipped int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Scanned += scanned
+	r.Skipped += skipped
+}
+
+func (r *Report) Upload(files int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Uploaded += files
+}
+
+// Sent counts bytes that went to a destination, encrypted files are bigger and cut short ones still count
+func (r *Report) Sent(bytes int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.BytesUploaded += bytes
+}
+
+// Leave counts files left for the next run, because the run stopped before they went up
+func (r *Report) Leave(files int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Remaining += files
+}
+
+func (r *Report) Delete(files int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Deleted += files
+}
+
+func (r *Report) Fail(destination, path string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Failed++
+	r.Failures = append(r.Failures, Failure{Destination: destination, Path: path, Error: err.Error()})
+}
+
+// Reauthorize records a destination whose sign in has stopped working
+func (r *Report) Reauthorize(destination string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !slices.Contains(r.NeedsReauthorize, destination) {
+		r.NeedsReauthorize = append(r.NeedsReauthorize, destination)
+	}
+}
+
+// Stop records why the run is finishing early, like the upload window closing
+func (r *Report) Stop(reason string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Stopped = reason
+}
+
+// SetFatal records what stopped the run
+func (r *Report) SetFatal(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Fatal = err.Error()
+}
+
+// Finish fills in the status and how long the run took
+func (r *Report) Finish(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Finished = now
+	r.DurationSeconds = now.Sub(r.Started).Seconds()
+	switch {
+	case r.Fatal != "":
+		r.Status = StatusFatal
+	case len(r.NeedsReauthorize) > 0:
+		r.Status = StatusReauthorize
+	case r.Failed > 0 || r.Remaining > 0:
+		r.Status = StatusPartial
+	default:
+		r.Status = StatusSuccess
+	}
+}
+
+// ExitCode is what the run should exit with, once it has finished
+func (r *Report) ExitCode() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch r.Status {
+	case StatusFatal:
+		return ExitFatal
+	case StatusReauthorize:
+		return ExitReauthorize
+	case StatusPartial:
+		return ExitPartial
+	}
+	return ExitSuccess
+}
+
+// Summary is a line for the log
+func (r *Report) Summary() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	summary := fmt.Sprintf("%s: %d scanned, %d uploaded (%d bytes), %d skipped, %d failed, %d deleted in %.0fs",
+		r.Status, r.Scanned, r.Uploaded, r.BytesUploaded, r.Skipped, r.Failed, r.Deleted, r.DurationSeconds)
+	if r.Remaining > 0 {
+		summary += fmt.Sprintf(", %d left for the next run", r.Remaining)
+	}
+	if len(r.NeedsReauthorize) > 0 {
+		summary += ", re-authorization required for " + strings.Join(r.NeedsReauthorize, ", ")
+	}
+	return summary
+}
+
+// Write saves the report as JSON, replacing the last one in one go so nothing reads half a report
+func (r *Report) Write(path string) error {
+	r.lock.Lock()
+	b, err := json.MarshalIndent(r, "", "  ")
+	r.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	err = os.WriteFile(tmp, b, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write report, %s", err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not write report, %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReport(t *testing.T) {
+	started := time.Date(2024, 7, 14, 1, 0, 0, 0, time.UTC)
+	r := New(started)
+	r.Scan(10, 6)
+	r.Upload(3)
+	r.Sent(1000)
+	r.Sent(2000)
+	r.Fail("gdrive", "/docs/a.txt", errors.New("quota exceeded"))
+	r.Delete(1)
+	r.Finish(started.Add(90 * time.Second))
+	require.Equal(t, StatusPartial, r.Status)
+	require.Equal(t, ExitPartial, r.ExitCode())
+	require.Equal(t, "partial: 10 scanned, 3 uploaded (3000 bytes), 6 skipped, 1 failed, 1 deleted in 90s", r.Summary())
+
+	path := filepath.Join(t.TempDir(), "report.json")
+	require.NoError(t, r.Write(path))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var written map[string]any
+	require.NoError(t, json.Unmarshal(b, &written))
+	require.Equal(t, "partial", written["status"])
+	require.EqualValues(t, 90, written["durationSeconds"])
+	require.EqualValues(t, 3000, written["bytesUploaded"])
+	require.Equal(t, []any{map[string]any{"destination": "gdrive", "path": "/docs/a.txt", "error": "quota exceeded"}}, written["failures"])
+	require.NotContains(t, written, "fatal")
+
+	ok := New(started)
+	ok.Stop("the upload window has closed")
+	ok.Finish(started)
+	require.Equal(t, ExitSuccess, ok.ExitCode(), "stopping at the end of the window isn't a failure")
+
+	unfinished := New(started)
+	unfinished.Stop("the upload window has closed")
+	unfinished.Leave(4)
+	unfinished.Finish(started)
+	require.Equal(t, ExitPartial, unfinished.ExitCode(), "but leaving files behind is")
+	require.Contains(t, unfinished.Summary(), "4 left for the next run")
+
+	fatal := New(started)
+	fatal.Fail("gdrive", "", errors.New("could not list"))
+	fatal.SetFatal(errors.New("no source"))
+	fatal.Finish(started)
+	require.Equal(t, ExitFatal, fatal.ExitCode())
+
+	revoked := New(started)
+	revoked.Fail("gdrive", "", errors.New("re-authorization required"))
+	revoked.Reauthorize("gdrive")
+	revoked.Reauthorize("gdrive")
+	revoked.Finish(started)
+	require.Equal(t, StatusReauthorize, revoked.Status)
+	require.Equal(t, ExitReauthorize, revoked.ExitCode())
+	require.Equal(t, []string{"gdrive"}, revoked.NeedsReauthorize)
+	require.Contains(t, revoked.Summary(), "re-authorization required for gdrive")
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/throttle"
+)
+
+// restoreTarget is a source that files can be written back to. UploadFile must only replace what is at
+// filePath once the reader has been read to the end, a damaged backup only fails to decrypt part way through.
+type restoreTarget interface {
+	UploadFile(filePath string, reader io.Reader, modTime time.Time) error
+}
+
+// runRestore pulls the backed up files from the destination and writes them back to where they were backed up from
+func runRestore(args []string, destinations []namedDestination, sources map[string]backup.Source, dirs []config.DirectoryConfig,
+	keys map[string]*backup.Key, limiter *throttle.Throttle) {
+	if len(destinations) == 0 {
+		log.Fatalf("There are no destinations to restore from")
+	}
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	to := flags.String("to", "", "Folder to restore into, use / to put files back where they came from")
+	only := flags.String("dir", "", "Only restore this directory from the config")
+	from := flags.String("from", destinations[0].name, "Destination to restore from")
+	flags.Parse(args)
+	if *to == "" {
+		log.Fatalf("restore needs a folder to restore into, set -to")
+	}
+	var dst backup.Destination
+	for _, d := range destinations {
+		if d.name == *from {
+			dst = d
+		}
+	}
+	if dst == nil {
+		log.Fatalf("There is no destination called %s", *from)
+	}
+
+	log.Printf("Searching %s", *from)
+	backedUp, err := dst.List()
+	if err != nil {
+		log.Fatalf("Could not generate %s list, %s", *from, err)
+	}
+
+	var failed int
+	for _, dir := range dirs {
+		if *only != "" && dir.Dir != *only {
+			continue
+		}
+		target, ok := sources[dir.SourceType()].(restoreTarget)
+		if !ok {
+			log.Fatalf("Can't restore %s, its source can't be written to", dir.Dir)
+		}
+		files := filesInDir(backedUp, dir.Dir)
+		log.Printf("Restoring %d files from %s into %s", len(files), dir.Dir, *to)
+		if dryRun {
+			for _, file := range files {
+				log.Printf("Would restore %s", file.Path)
+			}
+			continue
+		}
+		failed += restoreFiles(files, dst, target, *to, keys[dir.Dir], limiter.For(dir.Limits), 4)
+	}
+
+	if failed > 0 {
+		log.Fatalf("Failed to restore %d files", failed)
+	}
+	log.Printf("Restore finished")
+}
+
+// filesInDir picks the files that were backed up from dir
+func filesInDir(items []backup.Item, dir string) []backup.Item {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	var files []backup.Item
+	for _, item := range items {
+		if !item.Dir && strings.HasPrefix(item.Path, prefix) {
+			files = append(files, item)
+		}
+	}
+	return files
+}
+
+// restoreFiles downloads, decrypts and uploads the files, returning how many failed
+func restoreFiles(files []backup.Item, dst backup.Destination, target restoreTarget, to string, key *backup.Key, limiter backup.Throttle, numWorkers int) int {
+	log.Printf("Restoring files with %d workers", numWorkers)
+
+	tasks := make(chan backup.Item, len(files))
+	var failed atomic.Int32
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for file := range tasks {
+				f, err := dst.Get(file)
+				if err != nil {
+					log.Printf("Failed to download %s: %s", file.Path, err)
+					failed.Add(1)
+					continue
+				}
+
+				reader := limiter.Download(f)
+				if key != nil {
+					reader, err = key.Decrypt(reader)
+					if err != nil {
+						log.Printf("Failed to decrypt %s: %s", file.Path, err)
+						f.Close()
+						failed.Add(1)
+						continue
+					}
+				}
+
+				restoredPath := path.Join(to, file.Path)
+				err = target.UploadFile(restoredPath, reader, file.ModificationTime)
+				f.Close()
+				if err != nil {
+					log.Printf("Failed to restore %s: %s", file.Path, err)
+					failed.Add(1)
+					continue
+				}
+				log.Printf("Restored %s to %s", file.Path, restoredPath)
+			}
+		}()
+	}
+
+	for _, file := range files {
+		tasks <- file
+	}
+	close(tasks)
+
+	wg.Wait()
+	return int(failed.Load())
+}
@@ -0,0 +1,275 @@
+// Package retry decides which errors are worth trying again and waits between the tries
+package retry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+	"google.golang.org/api/googleapi"
+)
+
+// Policy is how many times to try and how long to wait in between. The wait doubles each time
+// up to Max, with full jitter so a lot of workers hitting the same limit don't all come back at once.
+type Policy struct {
+	Attempts int
+	Base     time.Duration
+	Max      time.Duration
+}
+
+// Default is what the clients use
+var Default = Policy{Attempts: 5, Base: time.Second, Max: time.Minute}
+
+// sleep is swapped out in tests
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Backoff is how long to wait before the attempt after attempt, which starts at 0
+func (p Policy) Backoff(attempt int) time.Duration {
+	wait := p.Max
+	if attempt < 32 && p.Base<<attempt < p.Max && p.Base<<attempt > 0 {
+		wait = p.Base << attempt
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(wait) + 1))
+}
+
+// wait is the backoff, unless the server said how long to wait
+func (p Policy) wait(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, p.Max)
+	}
+	return p.Backoff(attempt)
+}
+
+// Do runs fn until it works, returns an error that isn't worth retrying, runs out of attempts or
+// ctx is done while waiting for the next one
+func Do(ctx context.Context, p Policy, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < max(p.Attempts, 1); attempt++ {
+		if attempt > 0 {
+			if sleepErr := sleep(ctx, p.wait(attempt-1, RetryAfter(err))); sleepErr != nil {
+				return fmt.Errorf("%w, stopped retrying after %w", sleepErr, err)
+			}
+		}
+		err = fn()
+		if err == nil || !Retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// Retryable says if err is a blip that could go away, rather than something that will fail every time
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		if retryableStatus(apiErr.Code) {
+			return true
+		}
+		// drive sends rate limits as 403s
+		for _, item := range apiErr.Errors {
+			if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+		return false
+	}
+	var davErr gowebdav.StatusError
+	if errors.As(err, &davErr) {
+		return retryableStatus(davErr.Status)
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return retryableStatus(statusErr.StatusCode)
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500
+}
+
+// StatusError is a response the client didn't like, for clients that don't have an error type of their own
+type StatusError struct {
+	StatusCode int
+	Header     http.Header
+}
+
+func (e *StatusError) Error() string {
+	return "server returned " + strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode)
+}
+
+// RetryAfter is how long the server behind err asked us to wait, 0 if it didn't say
+func RetryAfter(err error) time.Duration {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return parseRetryAfter(apiErr.Header.Get("Retry-After"))
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return parseRetryAfter(statusErr.Header.Get("Retry-After"))
+	}
+	return 0
+}
+
+// parseRetryAfter reads either form of Retry-After, seconds or a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
+
+// Transport retries requests that fail with a retryable status or connection error. Only methods that
+// can be sent twice without doing something twice are retried, a folder create that timed out might
+// have been made. Requests with a body are only retried if the body can be read again, which uploads
+// streamed from a file can't.
+type Transport struct {
+	Base   http.RoundTripper // http.DefaultTransport if nil
+	Policy Policy
+
+	lock sync.Mutex
+	run  context.Context // see Within
+}
+
+// NewTransport wraps base with the default policy
+func NewTransport(base http.RoundTripper) *Transport {
+	return &Transport{Base: base, Policy: Default}
+}
+
+// Within stops the waits between tries once ctx is done, as well as when the request's own context is.
+// The clients don't pass the run's context to every request, so this is how a retry finds out the
+// upload window has closed. It does nothing on a nil Transport, for clients set up without one.
+func (t *Transport) Within(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.run = ctx
+}
+
+// waitContext is done when either the request or the run is
+func (t *Transport) waitContext(req *http.Request) (context.Context, context.CancelFunc) {
+	t.lock.Lock()
+	run := t.run
+	t.lock.Unlock()
+	if run == nil || run.Done() == nil {
+		return req.Context(), func() {}
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	if run.Err() != nil {
+		cancel(context.Cause(run)) // AfterFunc would get there, but not before a sleep starts
+	}
+	stop := context.AfterFunc(run, func() { cancel(context.Cause(run)) })
+	return ctx, func() {
+		stop()
+		cancel(nil)
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	canReplay := idempotent[req.Method] && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+
+	for attempt := 0; ; attempt++ {
+		resp, err := base.RoundTrip(req)
+		var retryAfter time.Duration
+		switch {
+		case err != nil:
+			if !Retryable(err) {
+				return nil, err
+			}
+		case retryableStatus(resp.StatusCode) || rateLimited(resp):
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		default:
+			return resp, nil
+		}
+		if !canReplay || attempt+1 >= max(t.Policy.Attempts, 1) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024)) // so the connection can be used again
+			resp.Body.Close()
+		}
+
+		ctx, cancel := t.waitContext(req)
+		err = sleep(ctx, t.Policy.wait(attempt, retryAfter))
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// idempotent methods are the ones the transport retries, PROPFIND is how webdav lists
+var idempotent = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true,
+	http.MethodPut: true, http.MethodDelete: true, "PROPFIND": true,
+}
+
+// rateLimited says if resp is one of drive's rate limits, which it sends as a 403 with the reason in
+// the body. The body is put back for whoever reads the response.
+func rateLimited(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden {
+		return false
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	if err != nil {
+		return false
+	}
+	return Retryable(googleapi.CheckResponse(&http.Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: io.NopCloser(bytes.NewReader(b))}))
+}
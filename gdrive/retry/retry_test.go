@@ -0,0 +1,208 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/studio-b12/gowebdav"
+	"google.golang.org/api/googleapi"
+)
+
+// noSleep records the waits instead of waiting
+func noSleep(t *testing.T) *[]time.Duration {
+	var waits []time.Duration
+	old := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return context.Cause(ctx)
+	}
+	t.Cleanup(func() { sleep = old })
+	return &waits
+}
+
+func TestRetryable(t *testing.T) {
+	for name, tc := range map[string]struct {
+		err       error
+		retryable bool
+	}{
+		"drive rate limit":     {&googleapi.Error{Code: 429}, true},
+		"drive server error":   {fmt.Errorf("error uploading file: %w", &googleapi.Error{Code: 503}), true},
+		"drive 403 rate limit": {&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, true},
+		"drive 403 forbidden":  {&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "insufficientFilePermissions"}}}, false},
+		"drive not found":      {&googleapi.Error{Code: 404}, false},
+		"webdav server error":  {fmt.Errorf("could not read directory, %w", gowebdav.NewPathError("ReadDir", "/", 502)), true},
+		"webdav not found":     {gowebdav.NewPathError("ReadDir", "/", 404), false},
+		"our status error":     {&StatusError{StatusCode: 500}, true},
+		"connection reset":     {&os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}, true},
+		"cut short":            {io.ErrUnexpectedEOF, true},
+		"cancelled":            {fmt.Errorf("stopped, %w", context.Canceled), false},
+		"missing file":         {os.ErrNotExist, false},
+		"something else":       {errors.New("bad key"), false},
+	} {
+		require.Equal(t, tc.retryable, Retryable(tc.err), name)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{Attempts: 10, Base: time.Second, Max: 10 * time.Second}
+	for attempt := 0; attempt < 10; attempt++ {
+		limit := min(time.Second<<attempt, 10*time.Second)
+		for i := 0; i < 100; i++ {
+			wait := p.Backoff(attempt)
+			require.GreaterOrEqual(t, wait, time.Duration(0))
+			require.LessOrEqual(t, wait, limit)
+		}
+	}
+	require.LessOrEqual(t, p.Backoff(100), 10*time.Second, "no overflow")
+}
+
+func TestDo(t *testing.T) {
+	waits := noSleep(t)
+	p := Policy{Attempts: 4, Base: time.Millisecond, Max: time.Minute}
+
+	calls := 0
+	err := Do(context.Background(), p, func() error {
+		calls++
+		if calls < 3 {
+			return &googleapi.Error{Code: 429, Header: http.Header{"Retry-After": {"7"}}}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+	require.Equal(t, []time.Duration{7 * time.Second, 7 * time.Second}, *waits)
+
+	calls = 0
+	err = Do(context.Background(), p, func() error {
+		calls++
+		return errors.New("permanent")
+	})
+	require.EqualError(t, err, "permanent")
+	require.Equal(t, 1, calls)
+
+	calls = 0
+	err = Do(context.Background(), p, func() error {
+		calls++
+		return &StatusError{StatusCode: 503}
+	})
+	require.Error(t, err)
+	require.Equal(t, 4, calls, "gives up after the attempts")
+
+	// the run ending stops it waiting for the next go
+	ctx, cancel := context.WithCancelCause(context.Background())
+	stopped := errors.New("window closed")
+	cancel(stopped)
+	calls = 0
+	err = Do(ctx, p, func() error {
+		calls++
+		return &StatusError{StatusCode: 503}
+	})
+	require.ErrorIs(t, err, stopped)
+	require.Equal(t, 1, calls)
+}
+
+func TestTransport(t *testing.T) {
+	waits := noSleep(t)
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if len(bodies) < 3 {
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "done")
+	}))
+	defer server.Close()
+	transport := &Transport{Policy: Policy{Attempts: 5, Base: time.Millisecond, Max: time.Minute}}
+	client := &http.Client{Transport: transport}
+	put := func(body io.Reader) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, server.URL, body)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := put(strings.NewReader("hello"))
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, "done", string(b))
+	require.Equal(t, []string{"hello", "hello", "hello"}, bodies, "the body is sent again each time")
+	require.Equal(t, []time.Duration{2 * time.Second, 2 * time.Second}, *waits)
+
+	// a body that can't be read again gets one go
+	bodies = nil
+	resp = put(io.MultiReader(strings.NewReader("stream")))
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Len(t, bodies, 1)
+
+	// so does a POST, the server might have done it before failing
+	bodies = nil
+	resp, err := client.Post(server.URL, "text/plain", strings.NewReader("create"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Len(t, bodies, 1)
+
+	// once the run is over it stops waiting, even though the request's own context carries on
+	bodies = nil
+	run, cancel := context.WithCancelCause(context.Background())
+	stopped := errors.New("window closed")
+	cancel(stopped)
+	transport.Within(run)
+	req, err := http.NewRequest(http.MethodPut, server.URL, strings.NewReader("late"))
+	require.NoError(t, err)
+	_, err = client.Do(req)
+	require.ErrorIs(t, err, stopped)
+	require.Len(t, bodies, 1)
+}
+
+func TestTransportRateLimit(t *testing.T) {
+	noSleep(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/denied":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":{"code":403,"message":"no","errors":[{"reason":"insufficientPermissions"}]}}`)
+		case requests < 3:
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"error":{"code":403,"message":"slow down","errors":[{"reason":"userRateLimitExceeded"}]}}`)
+		default:
+			fmt.Fprint(w, "done")
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &Transport{Policy: Policy{Attempts: 5, Base: time.Millisecond, Max: time.Minute}}}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, "done", string(b))
+	require.Equal(t, 3, requests)
+
+	// other 403s aren't going to change, and the body is still there to say why
+	requests = 0
+	resp, err = client.Get(server.URL + "/denied")
+	require.NoError(t, err)
+	b, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, 1, requests)
+	require.Contains(t, string(b), "insufficientPermissions")
+}
@@ -0,0 +1,212 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/retry"
+)
+
+// Client talks to S3 compatible storage (AWS, MinIO, Backblaze B2, Wasabi...) using path style
+// requests signed with AWS signature version 4
+type Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+	retry     *retry.Transport
+	now       func() time.Time
+}
+
+func NewClient(endpoint, region, bucket, accessKey, secretKey string) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("endpoint %s is not a url", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket set")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	transport := retry.NewTransport(nil)
+	return &Client{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		http:      &http.Client{Transport: transport},
+		retry:     transport,
+		now:       time.Now,
+	}, nil
+}
+
+// Within stops the waits between retries once ctx is done
+func (c *Client) Within(ctx context.Context) {
+	c.retry.Within(ctx)
+}
+
+// Error is what S3 sends back when a request fails
+type Error struct {
+	StatusCode int
+	Header     http.Header `xml:"-"`
+	Code       string      `xml:"Code"`
+	Message    string      `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("s3 returned %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// codeStatus is the status of the errors S3 can send with some other one, a completion fails with a 200
+var codeStatus = map[string]int{
+	"InternalError":  http.StatusInternalServerError,
+	"SlowDown":       http.StatusServiceUnavailable,
+	"RequestTimeout": http.StatusRequestTimeout,
+}
+
+// Unwrap lets retry tell the blips from the errors that will keep happening
+func (e *Error) Unwrap() error {
+	status := e.StatusCode
+	if code, ok := codeStatus[e.Code]; ok {
+		status = code
+	}
+	return &retry.StatusError{StatusCode: status, Header: e.Header}
+}
+
+// do sends a request for key in the bucket. A nil body is sent empty, anything else has
+// to be a bytes.Reader so the length is known, which S3 needs.
+func (c *Client) do(method, key string, query url.Values, headers http.Header, body *bytes.Reader) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = "/" + c.bucket + "/" + key
+	u.RawPath = "/" + c.bucket + "/" + escapePath(key) // S3 wants keys escaped its way, not Go's
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = body
+	}
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	c.sign(req)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		s3Err := &Error{StatusCode: resp.StatusCode, Header: resp.Header}
+		b, _ := io.ReadAll(resp.Body)
+		xml.Unmarshal(b, s3Err)
+		return nil, s3Err
+	}
+	return resp, nil
+}
+
+// sign adds a version 4 signature. The payload isn't hashed so large parts don't have to be read twice.
+func (c *Client) sign(req *http.Request) {
+	now := c.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	signingKey = hmacSHA256(signingKey, c.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, escape(key)+"="+escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// escapePath escapes everything but the unreserved characters and slashes, which is how S3 signs paths
+func escapePath(s string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~', b == '/':
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
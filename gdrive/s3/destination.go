@@ -0,0 +1,280 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+)
+
+const (
+	// where the source modification time is kept, S3's own LastModified is the upload time
+	mtimeHeader     = "X-Amz-Meta-Mtime"
+	hashHeader      = "X-Amz-Meta-Sha256"
+	etagHeader      = "X-Amz-Meta-Source-Etag"
+	defaultPartSize = 16 * 1024 * 1024
+	minPartSize     = 5 * 1024 * 1024 // S3 won't take smaller parts, apart from the last
+	headWorkers     = 8
+)
+
+// Destination keeps backups as objects under a prefix in a bucket
+type Destination struct {
+	client   *Client
+	prefix   string
+	partSize int
+}
+
+// NewDestination stores objects under prefix. Files bigger than partSize are sent with a multipart upload,
+// a partSize of 0 uses the default.
+func NewDestination(client *Client, prefix string, partSize int) *Destination {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	if partSize == 0 {
+		partSize = defaultPartSize
+	}
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	return &Destination{client: client, prefix: prefix, partSize: partSize}
+}
+
+func (d *Destination) Within(ctx context.Context) {
+	d.client.Within(ctx)
+}
+
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List returns every object under the prefix. Listings don't include metadata, so each object's
+// modification time is fetched with a HEAD request.
+func (d *Destination) List() ([]backup.Item, error) {
+	var items []backup.Item
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {d.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := d.client.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list objects: %w", err)
+		}
+		var result listResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read object list: %w", err)
+		}
+		for _, object := range result.Contents {
+			if strings.HasSuffix(object.Key, "/") {
+				continue // a folder placeholder made by some other tool
+			}
+			itemPath := "/" + strings.TrimPrefix(object.Key, d.prefix)
+			items = append(items, backup.Item{
+				ID:               object.Key,
+				Path:             itemPath,
+				Name:             path.Base(itemPath),
+				ModificationTime: object.LastModified,
+				Size:             object.Size,
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	err := d.readModTimes(items)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Got %d items", len(items))
+	return items, nil
+}
+
+// readModTimes swaps the upload times from the listing for the times we stored when uploading, and picks up the hashes
+func (d *Destination) readModTimes(items []backup.Item) error {
+	tasks := make(chan int, len(items))
+	for i := range items {
+		tasks <- i
+	}
+	close(tasks)
+
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var firstErr error
+	for i := 0; i < headWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				resp, err := d.client.do(http.MethodHead, items[i].ID, nil, nil, nil)
+				if err != nil {
+					errLock.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("unable to read %s: %w", items[i].ID, err)
+					}
+					errLock.Unlock()
+					continue
+				}
+				resp.Body.Close()
+				if mtime, err := time.Parse(time.RFC3339Nano, resp.Header.Get(mtimeHeader)); err == nil {
+					items[i].ModificationTime = mtime
+				}
+				items[i].Hash = resp.Header.Get(hashHeader)
+				items[i].ETag = resp.Header.Get(etagHeader)
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// EnsureFolder does nothing, object storage doesn't have folders
+func (d *Destination) EnsureFolder(string) error {
+	return nil
+}
+
+// Put uploads the file, replacing the old object in one step. Anything bigger than a part goes up as a multipart upload.
+func (d *Destination) Put(item backup.Item, reader io.Reader) error {
+	key := d.key(item.Path)
+	headers := http.Header{mtimeHeader: {item.ModificationTime.UTC().Format(time.RFC3339Nano)}}
+	if item.Hash != "" {
+		headers[hashHeader] = []string{item.Hash}
+		headers[etagHeader] = []string{item.ETag}
+	}
+
+	// the buffer only grows as big as the file, so small files stay cheap
+	var part bytes.Buffer
+	_, err := io.CopyN(&part, reader, int64(d.partSize))
+	if err == io.EOF {
+		resp, err := d.client.do(http.MethodPut, key, nil, headers, bytes.NewReader(part.Bytes()))
+		if err != nil {
+			return fmt.Errorf("error uploading %s: %w", item.Path, err)
+		}
+		resp.Body.Close()
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", item.Path, err)
+	}
+	return d.putMultipart(key, headers, &part, reader)
+}
+
+type initiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+// putMultipart uploads part, which is already full, and the rest of reader as parts
+func (d *Destination) putMultipart(key string, headers http.Header, part *bytes.Buffer, reader io.Reader) error {
+	resp, err := d.client.do(http.MethodPost, key, url.Values{"uploads": {""}}, headers, nil)
+	if err != nil {
+		return fmt.Errorf("error starting upload of %s: %w", key, err)
+	}
+	var initiated initiateResult
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error starting upload of %s: %w", key, err)
+	}
+
+	err = d.uploadParts(key, initiated.UploadID, part, reader)
+	if err != nil {
+		// leave nothing behind to be billed for
+		if resp, abortErr := d.client.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); abortErr == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *Destination) uploadParts(key, uploadID string, part *bytes.Buffer, reader io.Reader) error {
+	var complete completeUpload
+	for number := 1; part.Len() > 0; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := d.client.do(http.MethodPut, key, query, nil, bytes.NewReader(part.Bytes()))
+		if err != nil {
+			return fmt.Errorf("error uploading part %d of %s: %w", number, key, err)
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completePart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		part.Reset()
+		_, err = io.CopyN(part, reader, int64(d.partSize))
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading %s: %w", key, err)
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error finishing upload of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	// S3 can fail a completion after sending a 200, the error is in the body
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error finishing upload of %s: %w", key, err)
+	}
+	s3Err := &Error{StatusCode: resp.StatusCode, Header: resp.Header}
+	if xml.Unmarshal(b, s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("error finishing upload of %s: %w", key, s3Err)
+	}
+	return nil
+}
+
+func (d *Destination) Delete(item backup.Item) error {
+	resp, err := d.client.do(http.MethodDelete, d.key(item.Path), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error deleting %s: %w", item.Path, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (d *Destination) Get(item backup.Item) (io.ReadCloser, error) {
+	resp, err := d.client.do(http.MethodGet, d.key(item.Path), nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s: %w", item.Path, err)
+	}
+	return resp.Body, nil
+}
+
+func (d *Destination) key(itemPath string) string {
+	return d.prefix + strings.TrimPrefix(path.Clean("/"+itemPath), "/")
+}
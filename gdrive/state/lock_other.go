@@ -0,0 +1,22 @@
+//go:build !unix
+
+package state
+
+import "errors"
+
+var ErrLocked = errors.New("another run has the lock")
+
+type Lock struct{}
+
+// TryLock needs flock, which this platform doesn't have
+func TryLock(path string) (*Lock, error) {
+	return nil, errors.New("lockFile is only supported on unix")
+}
+
+// Unlock lets the lock go, it does nothing when there isn't one
+func (l *Lock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	return nil
+}
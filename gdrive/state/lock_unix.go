@@ -0,0 +1,48 @@
+//go:build unix
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// ErrLocked is returned when another run already has the lock
+var ErrLocked = errors.New("another run has the lock")
+
+// Lock is held by one run at a time, across processes
+type Lock struct {
+	f *os.File
+}
+
+// TryLock takes the lock at path, or returns ErrLocked straight away if something else has it.
+// The lock goes when the process does, so a crash never leaves it stuck.
+func TryLock(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file, %s", err)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("could not lock %s, %s", path, err)
+	}
+	// say who has it, for whoever finds the lock taken
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return &Lock{f: f}, nil
+}
+
+// Unlock lets the lock go, it does nothing when there isn't one
+func (l *Lock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	return l.f.Close()
+}
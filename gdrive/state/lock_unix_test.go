@@ -0,0 +1,24 @@
+//go:build unix
+
+package state
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "backup.lock")
+	lock, err := TryLock(lockPath)
+	require.NoError(t, err)
+
+	_, err = TryLock(lockPath)
+	require.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, lock.Unlock())
+	lock, err = TryLock(lockPath)
+	require.NoError(t, err)
+	require.NoError(t, lock.Unlock())
+}
@@ -0,0 +1,59 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+)
+
+// Sessions keeps resumable uploads between runs. It has a file of its own as it is
+// written after every chunk, and the state can be big.
+type Sessions struct {
+	path     string
+	lock     sync.Mutex
+	sessions map[string]backup.UploadSession
+}
+
+// LoadSessions reads the sessions from path, a missing file means there are none
+func LoadSessions(path string) (*Sessions, error) {
+	s := &Sessions{path: path, sessions: make(map[string]backup.UploadSession)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read upload sessions, %s", err)
+	}
+	err = json.Unmarshal(b, &s.sessions)
+	if err != nil {
+		return nil, fmt.Errorf("could not read upload sessions %s, %s", path, err)
+	}
+	return s, nil
+}
+
+func (s *Sessions) Session(key string) (backup.UploadSession, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[key]
+	return session, ok
+}
+
+func (s *Sessions) SaveSession(key string, session backup.UploadSession) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[key] = session
+	return writeJSON(s.path, s.sessions)
+}
+
+func (s *Sessions) DeleteSession(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.sessions[key]; !ok {
+		return nil
+	}
+	delete(s.sessions, key)
+	return writeJSON(s.path, s.sessions)
+}
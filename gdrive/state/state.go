@@ -0,0 +1,186 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+)
+
+// State remembers what has been backed up to each destination, so a run doesn't have to list them all again
+type State struct {
+	path         string
+	Destinations map[string]*Index `json:"destinations"` // keyed by destination name
+}
+
+// Index is what one destination has, as far as we know
+type Index struct {
+	Reconciled time.Time              `json:"reconciled"` // the last time this was checked against a full listing
+	Files      map[string]backup.Item `json:"files"`      // keyed by path
+	// where to pick up the destination's changes from, for destinations that can list them
+	ChangesToken string `json:"changesToken"`
+}
+
+// Load reads the state from path, a missing file is an empty state
+func Load(path string) (*State, error) {
+	s := &State{path: path, Destinations: make(map[string]*Index)}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read state, %s", err)
+	}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, fmt.Errorf("could not read state %s, %s", path, err)
+	}
+	if s.Destinations == nil {
+		s.Destinations = make(map[string]*Index)
+	}
+	return s, nil
+}
+
+// Save writes the state out
+func (s *State) Save() error {
+	return writeJSON(s.path, s)
+}
+
+// writeJSON writes v to a temporary file first and moves it into place, so a crash can't leave half of it behind
+func writeJSON(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not save %s, %s", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not save %s, %s", path, err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("could not save %s, %s", path, err)
+	}
+	return nil
+}
+
+// Index returns the index for the destination, making an empty one the first time
+func (s *State) Index(destination string) *Index {
+	index, ok := s.Destinations[destination]
+	if !ok {
+		index = &Index{Files: make(map[string]backup.Item)}
+		s.Destinations[destination] = index
+	}
+	if index.Files == nil {
+		index.Files = make(map[string]backup.Item)
+	}
+	return index
+}
+
+// Stale is true if the index hasn't been checked against the destination in maxAge
+func (i *Index) Stale(maxAge time.Duration, now time.Time) bool {
+	return i.Reconciled.IsZero() || now.Sub(i.Reconciled) > maxAge
+}
+
+func (i *Index) Items() []backup.Item {
+	items := make([]backup.Item, 0, len(i.Files))
+	for _, item := range i.Files {
+		items = append(items, item)
+	}
+	return items
+}
+
+// Reconcile replaces the index with a full listing of the destination, returning how many entries were wrong
+func (i *Index) Reconcile(items []backup.Item, now time.Time) int {
+	files := make(map[string]backup.Item, len(items))
+	drift := 0
+	for _, item := range items {
+		files[item.Path] = item
+		known, ok := i.Files[item.Path]
+		// sizes aren't compared, what we upload is the source size and encryption changes it
+		if !ok || !known.ModificationTime.Equal(item.ModificationTime) || known.Dir != item.Dir {
+			drift++
+		}
+	}
+	for filePath := range i.Files {
+		if _, ok := files[filePath]; !ok {
+			drift++
+		}
+	}
+	if drift > 0 && !i.Reconciled.IsZero() {
+		log.Printf("The saved state was out by %d files", drift)
+	}
+	i.Files = files
+	i.Reconciled = now
+	return drift
+}
+
+// Apply brings the index up to date with the changes a destination reports. A folder that has moved or
+// been renamed moves everything in it, which the changes don't say, so that gives backup.ErrFullListing.
+func (i *Index) Apply(changed []backup.Item, removed []string) error {
+	paths := make(map[string]string)
+	for filePath, item := range i.Files {
+		if item.ID != "" {
+			paths[item.ID] = filePath
+		}
+	}
+
+	for _, id := range removed {
+		filePath, ok := paths[id]
+		if !ok {
+			continue
+		}
+		if i.Files[filePath].Dir {
+			i.removeBelow(filePath)
+		}
+		delete(i.Files, filePath)
+	}
+	for _, item := range changed {
+		oldPath, ok := paths[item.ID]
+		if ok && oldPath != item.Path {
+			if old, ok := i.Files[oldPath]; ok && old.Dir {
+				return fmt.Errorf("%w, %s moved to %s", backup.ErrFullListing, oldPath, item.Path)
+			}
+			delete(i.Files, oldPath)
+		}
+		i.Files[item.Path] = item
+	}
+	return nil
+}
+
+func (i *Index) removeBelow(dir string) {
+	for filePath := range i.Files {
+		if strings.HasPrefix(filePath, dir+"/") {
+			delete(i.Files, filePath)
+		}
+	}
+}
+
+// Add records files that have been uploaded
+func (i *Index) Add(items ...backup.Item) {
+	for _, item := range items {
+		i.Files[item.Path] = item
+	}
+}
+
+// Remove forgets files that have been removed from the destination
+func (i *Index) Remove(items ...backup.Item) {
+	for _, item := range items {
+		delete(i.Files, item.Path)
+	}
+}
@@ -0,0 +1,77 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestState(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "state.json")
+	now := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	s, err := Load(statePath)
+	require.NoError(t, err)
+	index := s.Index("gdrive")
+	require.True(t, index.Stale(24*time.Hour, now))
+
+	listed := []backup.Item{
+		{ID: "1", Path: "/docs/a.txt", Name: "a.txt", ModificationTime: now, Size: 10, Hash: "aaa"},
+		{ID: "2", Path: "/docs/b.txt", Name: "b.txt", ModificationTime: now, Size: 20},
+	}
+	require.Equal(t, 2, index.Reconcile(listed, now))
+	index.Add(backup.Item{Path: "/docs/c.txt", Name: "c.txt", ModificationTime: now})
+	index.Remove(backup.Item{Path: "/docs/b.txt"})
+	require.NoError(t, s.Save())
+
+	s, err = Load(statePath)
+	require.NoError(t, err)
+	index = s.Index("gdrive")
+	require.False(t, index.Stale(24*time.Hour, now.Add(time.Hour)))
+	require.True(t, index.Stale(24*time.Hour, now.Add(25*time.Hour)))
+	require.Len(t, index.Items(), 2)
+	require.Equal(t, "aaa", index.Files["/docs/a.txt"].Hash)
+	require.Empty(t, s.Index("other").Items())
+
+	// c.txt never made it and b.txt is still there
+	require.Equal(t, 2, index.Reconcile(listed, now.Add(2*time.Hour)))
+	require.Equal(t, 0, index.Reconcile(listed, now.Add(3*time.Hour)))
+}
+
+func TestApply(t *testing.T) {
+	now := time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC)
+	s, err := Load(filepath.Join(t.TempDir(), "state.json"))
+	require.NoError(t, err)
+	index := s.Index("gdrive")
+	index.Reconcile([]backup.Item{
+		{ID: "d1", Path: "/docs", Dir: true},
+		{ID: "d2", Path: "/docs/sub", Dir: true},
+		{ID: "1", Path: "/docs/a.txt", ModificationTime: now},
+		{ID: "2", Path: "/docs/sub/b.txt", ModificationTime: now},
+		{ID: "3", Path: "/docs/c.txt", ModificationTime: now},
+	}, now)
+	index.Add(backup.Item{Path: "/docs/uploaded.txt", ModificationTime: now})
+
+	err = index.Apply([]backup.Item{
+		{ID: "1", Path: "/docs/a.txt", ModificationTime: now.Add(time.Hour)}, // changed
+		{ID: "3", Path: "/docs/renamed.txt", ModificationTime: now},          // moved
+		{ID: "4", Path: "/docs/uploaded.txt", ModificationTime: now},         // our upload, now with an ID
+	}, []string{"d2", "unknown"})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"/docs", "/docs/a.txt", "/docs/renamed.txt", "/docs/uploaded.txt"}, paths(index.Items()))
+	require.Equal(t, now.Add(time.Hour), index.Files["/docs/a.txt"].ModificationTime)
+	require.Equal(t, "4", index.Files["/docs/uploaded.txt"].ID)
+
+	err = index.Apply([]backup.Item{{ID: "d1", Path: "/documents", Dir: true}}, nil)
+	require.ErrorIs(t, err, backup.ErrFullListing)
+}
+
+func paths(items []backup.Item) []string {
+	var p []string
+	for _, item := range items {
+		p = append(p, item.Path)
+	}
+	return p
+}
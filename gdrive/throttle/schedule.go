@@ -0,0 +1,105 @@
+package throttle
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+)
+
+// Schedule is the times of day a run can upload in, and how fast in each. nil means any time.
+type Schedule []window
+
+type window struct {
+	start, end time.Duration // since midnight, local time
+	limits     config.Limits
+}
+
+// ParseSchedule reads the windows from the config
+func ParseSchedule(windows []config.Window) (Schedule, error) {
+	var schedule Schedule
+	for _, w := range windows {
+		start, err := parseClock(w.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(w.End)
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("window %s to %s is empty, use 00:00 to 24:00 for all day", w.Start, w.End)
+		}
+		schedule = append(schedule, window{start: start, end: end, limits: w.Limits})
+	}
+	return schedule, nil
+}
+
+// parseClock reads a time of day like 06:30, 24:00 is the end of the day
+func parseClock(value string) (time.Duration, error) {
+	var hour, minute int
+	_, err := fmt.Sscanf(value, "%d:%d", &hour, &minute)
+	if err != nil || hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("%q is not a time of day like 06:30", value)
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
+
+// At gives the limits of the first window now is in, false if it isn't in any
+func (s Schedule) At(now time.Time) (config.Limits, bool) {
+	if s == nil {
+		return config.Limits{}, true
+	}
+	for _, w := range s {
+		if w.contains(now) {
+			return w.limits, true
+		}
+	}
+	return config.Limits{}, false
+}
+
+// Closes is when the run has to stop by, which is the end of the window now is in or the end of
+// any window that carries on from it. It is false if the windows go all the way round the clock.
+func (s Schedule) Closes(now time.Time) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+	t := now
+	for t.Sub(now) < 24*time.Hour {
+		var next time.Time
+		for _, w := range s {
+			if end := w.endAfter(t); w.contains(t) && end.After(next) {
+				next = end
+			}
+		}
+		if next.IsZero() {
+			return t, true
+		}
+		t = next
+	}
+	return time.Time{}, false
+}
+
+func (w window) contains(t time.Time) bool {
+	clock := sinceMidnight(t)
+	if w.start < w.end {
+		return w.start <= clock && clock < w.end
+	}
+	return clock >= w.start || clock < w.end // over midnight
+}
+
+// endAfter is the next time the window ends after t
+func (w window) endAfter(t time.Time) time.Time {
+	year, month, day := t.Date()
+	end := time.Date(year, month, day, 0, 0, 0, 0, t.Location()).Add(w.end)
+	if !end.After(t) {
+		end = time.Date(year, month, day+1, 0, 0, 0, 0, t.Location()).Add(w.end)
+	}
+	return end
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	hour, minute, second := t.Clock()
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute + time.Duration(second)*time.Second +
+		time.Duration(t.Nanosecond())
+}
@@ -0,0 +1,134 @@
+// Package throttle keeps a run to the configured speeds and to the times of day it is allowed to upload in
+package throttle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+	"golang.org/x/time/rate"
+)
+
+// ErrWindowClosed is why a run stops when it gets to the end of its upload window
+var ErrWindowClosed = errors.New("the upload window has closed")
+
+const burst = 64 * 1024 // the most read at once, the limiters need a burst at least this big
+
+// Throttle limits what is read from sources and sent to destinations across the whole run,
+// and stops reads once ctx is done
+type Throttle struct {
+	*shared
+	dirUpload   *rate.Limiter // the directory's own limits, nil if it doesn't have any
+	dirDownload *rate.Limiter
+}
+
+// shared is the part of a Throttle every directory goes through
+type shared struct {
+	ctx      context.Context
+	limits   config.Limits
+	schedule Schedule
+	upload   *rate.Limiter
+	download *rate.Limiter
+
+	lock    sync.Mutex
+	current config.Limits
+}
+
+// New limits the run to limits, or the limits of the window it is in if there is a schedule
+func New(ctx context.Context, limits config.Limits, schedule Schedule) *Throttle {
+	s := &shared{ctx: ctx, limits: limits, schedule: schedule, current: limits,
+		upload: newLimiter(limits.UploadKBps), download: newLimiter(limits.DownloadKBps)}
+	s.apply(time.Now())
+	return &Throttle{shared: s}
+}
+
+// For adds a directory's own limits to the ones for the run
+func (t *Throttle) For(limits config.Limits) *Throttle {
+	dir := &Throttle{shared: t.shared}
+	if limits.UploadKBps > 0 {
+		dir.dirUpload = newLimiter(limits.UploadKBps)
+	}
+	if limits.DownloadKBps > 0 {
+		dir.dirDownload = newLimiter(limits.DownloadKBps)
+	}
+	return dir
+}
+
+// Upload limits what is sent to a destination
+func (t *Throttle) Upload(r io.ReadCloser) io.ReadCloser {
+	return &reader{ReadCloser: r, shared: t.shared, limiters: limiters(t.upload, t.dirUpload)}
+}
+
+// Download limits what is read from a source, or a destination when restoring
+func (t *Throttle) Download(r io.ReadCloser) io.ReadCloser {
+	return &reader{ReadCloser: r, shared: t.shared, limiters: limiters(t.download, t.dirDownload)}
+}
+
+// apply moves the run's limits on to the window it is in now
+func (s *shared) apply(now time.Time) {
+	if s.schedule == nil {
+		return
+	}
+	limits, ok := s.schedule.At(now)
+	if !ok {
+		return // the window is closing, ctx takes care of that
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if limits == s.current {
+		return
+	}
+	s.current = limits
+	s.upload.SetLimitAt(now, toLimit(limits.UploadKBps))
+	s.download.SetLimitAt(now, toLimit(limits.DownloadKBps))
+}
+
+func newLimiter(kbps int) *rate.Limiter {
+	return rate.NewLimiter(toLimit(kbps), burst)
+}
+
+func toLimit(kbps int) rate.Limit {
+	if kbps <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(kbps * 1024)
+}
+
+func limiters(all ...*rate.Limiter) []*rate.Limiter {
+	var set []*rate.Limiter
+	for _, l := range all {
+		if l != nil {
+			set = append(set, l)
+		}
+	}
+	return set
+}
+
+// reader waits on its limiters for every read
+type reader struct {
+	io.ReadCloser
+	*shared
+	limiters []*rate.Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, context.Cause(r.ctx)
+	}
+	if len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.apply(time.Now())
+	for _, l := range r.limiters {
+		if waitErr := l.WaitN(r.ctx, n); waitErr != nil {
+			// it would have to wait past the end of the run, so stop with it
+			<-r.ctx.Done()
+			return n, context.Cause(r.ctx)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,93 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ProjectOrangeJuice/gdrive-backup/gdrive/config"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func at(clock string) time.Time {
+	t, _ := time.ParseInLocation("2006-01-02 15:04", "2024-07-14 "+clock, time.Local)
+	return t
+}
+
+func TestSchedule(t *testing.T) {
+	schedule, err := ParseSchedule([]config.Window{
+		{Start: "01:00", End: "06:00"},
+		{Start: "22:00", End: "01:00", Limits: config.Limits{UploadKBps: 2048}},
+	})
+	require.NoError(t, err)
+
+	limits, open := schedule.At(at("03:00"))
+	require.True(t, open)
+	require.Equal(t, config.Limits{}, limits, "full speed at night")
+	limits, open = schedule.At(at("23:30"))
+	require.True(t, open)
+	require.Equal(t, 2048, limits.UploadKBps)
+	_, open = schedule.At(at("12:00"))
+	require.False(t, open)
+
+	// 22:00 runs into 01:00 which runs on to 06:00 the next morning
+	closes, ok := schedule.Closes(at("23:30"))
+	require.True(t, ok)
+	require.Equal(t, at("06:00").AddDate(0, 0, 1), closes)
+	closes, ok = schedule.Closes(at("05:59"))
+	require.True(t, ok)
+	require.Equal(t, at("06:00"), closes)
+
+	allDay, err := ParseSchedule([]config.Window{{Start: "00:00", End: "12:00"}, {Start: "12:00", End: "24:00"}})
+	require.NoError(t, err)
+	_, ok = allDay.Closes(at("15:00"))
+	require.False(t, ok)
+
+	var none Schedule
+	_, open = none.At(at("12:00"))
+	require.True(t, open, "no schedule is any time")
+
+	for _, bad := range []config.Window{{Start: "1am", End: "06:00"}, {Start: "01:00", End: "25:00"}, {Start: "01:00", End: "01:00"}} {
+		_, err = ParseSchedule([]config.Window{bad})
+		require.Error(t, err, bad)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3*burst)
+
+	// the first burst goes straight away, the other two take 200ms at 640KB/s
+	limiter := New(context.Background(), config.Limits{UploadKBps: 640}, nil)
+	start := time.Now()
+	b, err := io.ReadAll(limiter.Upload(io.NopCloser(bytes.NewReader(data))))
+	require.NoError(t, err)
+	require.Equal(t, data, b)
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	// downloads and other directories aren't held up by it, only by the run's download limit which is off
+	download := limiter.For(config.Limits{}).Download(io.NopCloser(bytes.NewReader(data))).(*reader)
+	require.Equal(t, []*rate.Limiter{limiter.download}, download.limiters)
+	require.Equal(t, rate.Inf, limiter.download.Limit())
+
+	// a directory's own limit applies on top
+	start = time.Now()
+	_, err = io.ReadAll(New(context.Background(), config.Limits{}, nil).For(config.Limits{DownloadKBps: 640}).
+		Download(io.NopCloser(bytes.NewReader(data))))
+	require.NoError(t, err)
+	require.Greater(t, time.Since(start), 150*time.Millisecond)
+}
+
+func TestThrottleWindowCloses(t *testing.T) {
+	ctx, cancel := context.WithDeadlineCause(context.Background(), time.Now().Add(100*time.Millisecond), ErrWindowClosed)
+	defer cancel()
+	// far too slow to finish before the window closes
+	limiter := New(ctx, config.Limits{UploadKBps: 1}, nil)
+
+	start := time.Now()
+	_, err := io.ReadAll(limiter.Upload(io.NopCloser(bytes.NewReader(make([]byte, 10*burst)))))
+	require.ErrorIs(t, err, ErrWindowClosed)
+	require.Less(t, time.Since(start), time.Second)
+}